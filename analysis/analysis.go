@@ -0,0 +1,160 @@
+package analysis
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+// Status : the outcome of one check of a query
+type Status string
+
+const (
+	Pass         Status = "ok"
+	Fail         Status = "FAILED"
+	Inconclusive Status = "no data"
+)
+
+// TemplateVars : what the queries can refer to, eg. '{{.Release}}'
+type TemplateVars struct {
+	Release         string // the release being rolled out
+	PreviousRelease string // the release it takes over from (empty if there is none)
+	App             string // the app name plus the branch name (the same as KD_APP_NAME)
+	Namespace       string
+}
+
+// Result : one check of a query against its thresholds
+type Result struct {
+	Name        string
+	Value       float64
+	Baseline    float64 // the value for the previous release, if there are relative thresholds
+	HasBaseline bool
+	Status      Status
+	Reason      string
+}
+
+func (r Result) String() string {
+	switch {
+	case r.Status == Inconclusive:
+		return fmt.Sprintf("%s: %s (%s)", r.Name, r.Status, r.Reason)
+	case r.HasBaseline:
+		return strings.TrimSpace(fmt.Sprintf("%s: %g (previous release %g) - %s %s", r.Name, r.Value, r.Baseline, r.Status, r.Reason))
+	default:
+		return strings.TrimSpace(fmt.Sprintf("%s: %g - %s %s", r.Name, r.Value, r.Status, r.Reason))
+	}
+}
+
+// Evaluate runs every query for the release (and for the previous release, for relative thresholds), and checks
+// the values against the thresholds
+func Evaluate(client *Client, queries []config.AnalysisQuery, vars TemplateVars, at time.Time) []Result {
+	var results []Result
+	for _, query := range queries {
+		results = append(results, evaluateQuery(client, query, vars, at))
+	}
+	return results
+}
+
+func evaluateQuery(client *Client, query config.AnalysisQuery, vars TemplateVars, at time.Time) Result {
+	result := Result{Name: query.Name, Status: Pass}
+
+	value, found, err := runTemplatedQuery(client, query.Query, vars, at)
+	switch {
+	case err != nil:
+		result.Status, result.Reason = Inconclusive, err.Error()
+		return result
+	case !found:
+		result.Status, result.Reason = Inconclusive, "the query returned nothing for this release"
+		return result
+	}
+	result.Value = value
+
+	if query.Max != nil && value > *query.Max {
+		result.Status, result.Reason = Fail, fmt.Sprintf("(above the maximum of %g)", *query.Max)
+		return result
+	}
+	if query.Min != nil && value < *query.Min {
+		result.Status, result.Reason = Fail, fmt.Sprintf("(below the minimum of %g)", *query.Min)
+		return result
+	}
+
+	if query.MaxIncrease == nil && query.MaxDecrease == nil {
+		return result
+	}
+	if vars.PreviousRelease == "" {
+		result.Reason = "(no previous release to compare with)"
+		return result
+	}
+	// The same query, for the previous release
+	previousVars := vars
+	previousVars.Release = vars.PreviousRelease
+	baseline, found, err := runTemplatedQuery(client, query.Query, previousVars, at)
+	switch {
+	case err != nil:
+		result.Status, result.Reason = Inconclusive, err.Error()
+		return result
+	case !found:
+		result.Reason = "(the previous release has no data to compare with)"
+		return result
+	}
+	result.Baseline, result.HasBaseline = baseline, true
+
+	if query.MaxIncrease != nil && value > baseline*(1+*query.MaxIncrease) {
+		result.Status, result.Reason = Fail, fmt.Sprintf("(more than %g%% above the previous release)", *query.MaxIncrease*100)
+	} else if query.MaxDecrease != nil && value < baseline*(1-*query.MaxDecrease) {
+		result.Status, result.Reason = Fail, fmt.Sprintf("(more than %g%% below the previous release)", *query.MaxDecrease*100)
+	}
+	return result
+}
+
+func runTemplatedQuery(client *Client, queryTemplate string, vars TemplateVars, at time.Time) (float64, bool, error) {
+	tmpl, err := template.New("query").Option("missingkey=error").Parse(queryTemplate)
+	if err != nil {
+		return 0, false, err
+	}
+	var query bytes.Buffer
+	if err := tmpl.Execute(&query, vars); err != nil {
+		return 0, false, err
+	}
+	return client.Query(query.String(), at)
+}
+
+// RunCanaryAnalysis checks the queries every interval until the canary point's time is up. It fails as soon as
+// any query fails, and at the end if any query still has no data (since nothing says the canary is healthy then).
+func RunCanaryAnalysis(settings config.RolloutAnalysis, vars TemplateVars, duration time.Duration) bool {
+	client := NewClient(settings.PrometheusURL)
+	interval := time.Duration(settings.IntervalSeconds) * time.Second
+	deadline := time.Now().Add(duration)
+
+	fmt.Printf("=> Analysing the canary for %s, checking the metrics every %s.\n", duration, interval)
+	for {
+		now := time.Now()
+		results := Evaluate(client, settings.Queries, vars, now)
+		inconclusive := false
+		for _, result := range results {
+			fmt.Printf("=> [%s] %s\n", now.Format("15:04:05"), result)
+			if result.Status == Fail {
+				fmt.Println("=> Oh no, the canary analysis failed.")
+				return false
+			}
+			inconclusive = inconclusive || result.Status == Inconclusive
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if inconclusive {
+				fmt.Println("=> Oh no, some of the metrics still have no data, so the canary can't be trusted.")
+				return false
+			}
+			fmt.Println("=> The canary analysis passed.")
+			return true
+		}
+		if remaining > interval {
+			remaining = interval
+		}
+		time.Sleep(remaining)
+	}
+}
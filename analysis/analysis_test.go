@@ -0,0 +1,128 @@
+package analysis
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+// newTestServer stands in for a Prometheus-compatible query API, answering each query with the 'data' of the response
+// for it (or with an error response for a query it doesn't know)
+func newTestServer(t *testing.T, answers map[string]string) (*Client, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" {
+			t.Errorf("expected a request to /api/v1/query, got %s", r.URL.Path)
+		}
+		data, ok := answers[r.URL.Query().Get("query")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status": "error", "errorType": "bad_data", "error": "unknown query"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status": "success", "data": %s}`, data)
+	}))
+	return NewClient(server.URL + "/"), server
+}
+
+func vector(values ...string) string {
+	var series []string
+	for i, value := range values {
+		series = append(series, fmt.Sprintf(`{"metric": {"pod": "app-%d"}, "value": [1600000000, "%s"]}`, i, value))
+	}
+	return fmt.Sprintf(`{"resultType": "vector", "result": [%s]}`, strings.Join(series, ", "))
+}
+
+func TestQuery(t *testing.T) {
+	client, server := newTestServer(t, map[string]string{
+		"one_series":   vector("0.25"),
+		"scalar":       `{"resultType": "scalar", "result": [1600000000, "3"]}`,
+		"empty":        vector(),
+		"nan":          vector("NaN"),
+		"two_series":   vector("1", "2"),
+		"matrix":       `{"resultType": "matrix", "result": []}`,
+		"not_a_number": vector("lots"),
+	})
+	defer server.Close()
+
+	tests := []struct {
+		query     string
+		value     float64
+		found     bool
+		errorPart string
+	}{
+		{query: "one_series", value: 0.25, found: true},
+		{query: "scalar", value: 3, found: true},
+		{query: "empty"},
+		{query: "nan"},
+		{query: "two_series", errorPart: "returned 2 series"},
+		{query: "matrix", errorPart: "returned a matrix"},
+		{query: "not_a_number", errorPart: "isn't a number"},
+		{query: "unknown", errorPart: "the query failed (bad_data)"},
+	}
+	for _, test := range tests {
+		value, found, err := client.Query(test.query, time.Now())
+		if test.errorPart != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errorPart) {
+				t.Errorf("%s: expected an error with '%s', got %v", test.query, test.errorPart, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.query, err)
+		} else if value != test.value || found != test.found {
+			t.Errorf("%s: expected %g (found %t), got %g (found %t)", test.query, test.value, test.found, value, found)
+		}
+	}
+}
+
+func TestEvaluateQuery(t *testing.T) {
+	client, server := newTestServer(t, map[string]string{
+		`errors{release="new"}`:       vector("0.03"),
+		`errors{release="previous"}`:  vector("0.02"),
+		`latency{release="new"}`:      vector("0.2"),
+		`latency{release="previous"}`: vector("0.19"),
+		`missing{release="new"}`:      vector(),
+		`pods{release="new"}`:         vector("1", "1"),
+	})
+	defer server.Close()
+	vars := TemplateVars{Release: "new", PreviousRelease: "previous"}
+	limit := func(value float64) *float64 { return &value }
+
+	tests := []struct {
+		name   string
+		query  config.AnalysisQuery
+		status Status
+	}{
+		{"below the maximum", config.AnalysisQuery{Query: `errors{release="{{.Release}}"}`, Max: limit(0.05)}, Pass},
+		{"above the maximum", config.AnalysisQuery{Query: `errors{release="{{.Release}}"}`, Max: limit(0.01)}, Fail},
+		{"below the minimum", config.AnalysisQuery{Query: `errors{release="{{.Release}}"}`, Min: limit(0.1)}, Fail},
+		{"too much of an increase", config.AnalysisQuery{Query: `errors{release="{{.Release}}"}`, MaxIncrease: limit(0.2)}, Fail},
+		{"a small increase", config.AnalysisQuery{Query: `latency{release="{{.Release}}"}`, MaxIncrease: limit(0.2)}, Pass},
+		{"no data", config.AnalysisQuery{Query: `missing{release="{{.Release}}"}`, Max: limit(1)}, Inconclusive},
+		{"more than one series", config.AnalysisQuery{Query: `pods{release="{{.Release}}"}`, Max: limit(5)}, Inconclusive},
+		{"an unknown template variable", config.AnalysisQuery{Query: `errors{release="{{.Nope}}"}`, Max: limit(1)}, Inconclusive},
+	}
+	for _, test := range tests {
+		test.query.Name = test.name
+		result := evaluateQuery(client, test.query, vars, time.Now())
+		if result.Status != test.status {
+			t.Errorf("%s: expected %s, got %s", test.name, test.status, result)
+		}
+	}
+
+	// The relative thresholds compare with the previous release, which there may not be
+	result := evaluateQuery(client, config.AnalysisQuery{Name: "first release", Query: `errors{release="{{.Release}}"}`, MaxIncrease: limit(0.2)},
+		TemplateVars{Release: "new"}, time.Now())
+	if result.Status != Pass || result.HasBaseline {
+		t.Errorf("expected a pass without a baseline, got %s", result)
+	}
+	result = evaluateQuery(client, config.AnalysisQuery{Name: "baseline", Query: `latency{release="{{.Release}}"}`, MaxIncrease: limit(0.2)}, vars, time.Now())
+	if !result.HasBaseline || result.Baseline != 0.19 {
+		t.Errorf("expected the previous release's value as the baseline, got %s", result)
+	}
+}
@@ -0,0 +1,99 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client : a Prometheus-compatible query API (Prometheus itself, or eg. Thanos, Cortex or VictoriaMetrics)
+type Client struct {
+	URL        string // base URL, eg. 'http://prometheus.monitoring:9090' - '/api/v1/query' is added to it
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client for the query API at the base URL
+func NewClient(baseURL string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type queryResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// Query runs an instant query, which has to return a single number (a scalar, or a vector with one series).
+// found is false if the query returned no data (an empty vector, or NaN).
+func (c *Client) Query(query string, at time.Time) (value float64, found bool, err error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("time", strconv.FormatInt(at.Unix(), 10))
+	resp, err := c.HTTPClient.Get(c.URL + "/api/v1/query?" + params.Encode())
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, false, err
+	}
+
+	parsed := queryResponse{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return 0, false, fmt.Errorf("the query API answered with status %d, and not with JSON: %.200s", resp.StatusCode, body)
+	}
+	if parsed.Status != "success" {
+		return 0, false, fmt.Errorf("the query failed (%s): %s", parsed.ErrorType, parsed.Error)
+	}
+
+	var sample []interface{} // [ <unix time>, "<value>" ]
+	switch parsed.Data.ResultType {
+	case "scalar":
+		if err := json.Unmarshal(parsed.Data.Result, &sample); err != nil {
+			return 0, false, err
+		}
+	case "vector":
+		var series []struct {
+			Value []interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(parsed.Data.Result, &series); err != nil {
+			return 0, false, err
+		}
+		if len(series) == 0 {
+			return 0, false, nil
+		}
+		if len(series) > 1 {
+			return 0, false, fmt.Errorf("the query returned %d series, but it has to return one (use eg. sum() to combine them)", len(series))
+		}
+		sample = series[0].Value
+	default:
+		return 0, false, fmt.Errorf("the query returned a %s, but it has to return a single number", parsed.Data.ResultType)
+	}
+
+	if len(sample) != 2 {
+		return 0, false, fmt.Errorf("the query returned a malformed sample: %v", sample)
+	}
+	valueString, _ := sample[1].(string)
+	value, err = strconv.ParseFloat(valueString, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("the query returned the value '%v', which isn't a number", sample[1])
+	}
+	if math.IsNaN(value) {
+		return 0, false, nil // eg. a rate divided by a rate, while there's no traffic
+	}
+	return value, true, nil
+}
@@ -2,6 +2,6 @@ go get -d -v .
 
 for GOOS in linux darwin; do
     echo "\n\n=> Building for $GOOS\n"
-    GOOS=$GOOS GOARCH=amd64 go build -a -v .
+    GOOS=$GOOS GOARCH=amd64 go build -a -v -ldflags "-X main.version=$(git describe --tags --always)" .
     mv kube-deploy bin/kube-deploy-$GOOS
 done
@@ -1,9 +1,9 @@
 package build
 
 import (
-	"bufio"
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
@@ -13,8 +13,18 @@ import (
 
 const testCommandImage = "mycujoo/gcloud-docker"
 
-func MakeAndPushBuild(forcePush bool, dirtyWorkDirOverride bool, keepTestContainer bool, repoConfig config.RepoConfigMap) {
-	MakeAndTestBuild(dirtyWorkDirOverride, keepTestContainer, repoConfig)
+var invalidDockerNameCharRegex = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+func MakeAndPushBuild(forcePush bool, skipGitChecks []string, keepTestContainer bool, reuseImage bool, skipScan bool, skipTests bool, repoConfig config.RepoConfigMap) {
+	runGitChecksOrExit(skipGitChecks, repoConfig)
+	if reuseImage && reuseImageByContent(skipScan, skipTests, repoConfig) {
+		fmt.Printf("=> The image %s is ready, without building it again.\n", repoConfig.ImageFullPath)
+		metadata.Reused = true
+		metadata.Pushed = true
+		return
+	}
+	makeAndTestBuild(keepTestContainer, skipTests, repoConfig)
+	scanImageOrExit(builtImagePath(repoConfig), skipScan, repoConfig)
 	var pushExitCode int
 	if forcePush {
 		pushExitCode = forcePushDockerImage(repoConfig)
@@ -22,44 +32,74 @@ func MakeAndPushBuild(forcePush bool, dirtyWorkDirOverride bool, keepTestContain
 		pushExitCode = askPushDockerImage(repoConfig)
 	}
 	if pushExitCode != 0 {
-		os.Exit(1)
+		exitWithMetadata(repoConfig)
 	}
+	metadata.Pushed = true
 }
 
-func MakeAndTestBuild(dirtyWorkDirOverride bool, keepTestContainer bool, repoConfig config.RepoConfigMap) {
+func MakeAndTestBuild(skipGitChecks []string, keepTestContainer bool, repoConfig config.RepoConfigMap) {
+	runGitChecksOrExit(skipGitChecks, repoConfig)
+	makeAndTestBuild(keepTestContainer, false, repoConfig)
+}
+
+func makeAndTestBuild(keepTestContainer bool, skipTests bool, repoConfig config.RepoConfigMap) {
+	if repoConfig.Build.Backend == "kaniko" {
+		// The test sets run docker containers, which isn't possible without a docker daemon - so they're only
+		// skipped when that's asked for, and never for the production cluster
+		if len(repoConfig.Tests) > 0 {
+			if repoConfig.ClusterName == "production" {
+				fmt.Println("=> Sorry, the test sets can't run with Kaniko, since they need a local docker daemon, and they can't be skipped for the production cluster.")
+				exitWithMetadata(repoConfig)
+			}
+			if !skipTests {
+				fmt.Println("=> Uh oh, the test sets can't run with Kaniko, since they need a local docker daemon. Build with docker to run them, or use --skip-tests to build without them.")
+				exitWithMetadata(repoConfig)
+			}
+		}
+		buildStartTime := time.Now()
+		makeKanikoBuild(repoConfig)
+		metadata.BuildDurationSeconds = time.Since(buildStartTime).Seconds()
+		if len(repoConfig.Tests) > 0 {
+			fmt.Println("=> Skipping the test sets, like you asked.")
+			metadata.Tests = make([]TestResult, len(repoConfig.Tests))
+			for i, testSet := range repoConfig.Tests {
+				metadata.Tests[i] = TestResult{Name: testSet.Name, Status: "skipped"}
+			}
+		}
+		return
+	}
+
 	if !DockerAmLoggedIn(repoConfig.DockerRepository.RegistryRoot) {
 		fmt.Println("=> Uh oh, you're not logged into the configured docker remote for this repo. You won't be able to push!")
 		os.Exit(1)
 	}
 
-	// Builds the docker image and tags it with the image short-name (ie. without the registry path)
-	if repoConfig.ClusterName == "production" && !workingDirectoryIsClean() {
-		if dirtyWorkDirOverride {
-			fmt.Println("=> Respecting your wishes to override the dirty working directory and build anyway.")
-		} else {
-			fmt.Println("=> Oh no! You have uncommited changes in the working tree. Please commit or stash before deploying to production.")
-			fmt.Println("=> If you're really, really sure, you can override this warning with the '--override-dirty-workdir' flag.")
-			os.Exit(1)
-		}
-	}
-
+	buildStartTime := time.Now()
 	makeBuild(repoConfig)
+	metadata.BuildDurationSeconds = time.Since(buildStartTime).Seconds()
 	RunBuildTests(keepTestContainer, repoConfig)
 }
 
-func workingDirectoryIsClean() bool {
+// testsLabel records on the image how its test sets went, so that an image built without them is never reused
+// where they're required
+const testsLabel = "kubedeploy-tests"
 
-	cleanWorkDirChecks := []bool{
-
-		cli.GetCommandOutput("git", "status -s") == "", // checks for changes
-
-	}
-	for _, clean := range cleanWorkDirChecks {
-		if !clean {
-			return false
-		}
+// testsOutcome is the value of the tests label: 'passed' (the image is only pushed if the test sets pass), 'skipped'
+// (a Kaniko build with --skip-tests), or 'none' if there are no test sets
+func testsOutcome(repoConfig config.RepoConfigMap) string {
+	switch {
+	case len(repoConfig.Tests) == 0:
+		return "none"
+	case repoConfig.Build.Backend == "kaniko":
+		return "skipped"
+	default:
+		return "passed"
 	}
-	return true
+}
+
+// testsRequired is true if this build couldn't skip the test sets
+func testsRequired(skipTests bool, repoConfig config.RepoConfigMap) bool {
+	return len(repoConfig.Tests) > 0 && (repoConfig.ClusterName == "production" || !skipTests)
 }
 
 func makeBuild(repoConfig config.RepoConfigMap) {
@@ -70,116 +110,302 @@ func makeBuild(repoConfig config.RepoConfigMap) {
 	buildArgs := ""
 
 	if repoConfig.Application.ExposeBuildArgs {
-		// expose all branch variables as build arguments
-		for key, value := range repoConfig.EnvVarsMap {
+		// expose all branch variables (except the build secrets) as build arguments
+		for key, value := range exposedBuildArgs(repoConfig) {
 			buildArgs += fmt.Sprintf("--build-arg %s=%s ", key, value)
 		}
 
 		fmt.Println("=> Exposing ALL branch variables as build arguments")
 	}
 
-	DockerImageExistsRemote(repoConfig.ImageCachePath)
+	buildArgs += fmt.Sprintf("--label %s=%s ", testsLabel, testsOutcome(repoConfig))
+
+	removeSecretFiles := func() {}
+	if len(repoConfig.Build.Secrets) > 0 || len(repoConfig.Build.SSH) > 0 {
+		// Secrets and SSH forwarding are only available with BuildKit
+		os.Setenv("DOCKER_BUILDKIT", "1")
+		var secretArgs string
+		secretArgs, removeSecretFiles = secretBuildArgs(repoConfig)
+		buildArgs += secretArgs
+	}
+
+	buildCommand := "build"
+	cacheArgs := ""
+	switch repoConfig.Build.Cache.Mode {
+	case "registry":
+		// BuildKit reads and writes the cache straight from the registry, so nothing needs to be pulled or tagged
+		buildCommand = "buildx build --load"
+		for _, cachePath := range repoConfig.ImageCacheFromPaths {
+			cacheArgs += fmt.Sprintf("--cache-from type=registry,ref=%s ", cachePath)
+		}
+		cacheArgs += fmt.Sprintf("--cache-to type=registry,ref=%s,mode=max ", repoConfig.ImageBranchCachePath)
+		if updatesVersionCache(repoConfig) {
+			cacheArgs += fmt.Sprintf("--cache-to type=registry,ref=%s,mode=max ", repoConfig.ImageCachePath)
+		}
+	case "inline":
+		// BuildKit only fetches the layers it needs from the cache images, so they don't have to be pulled first
+		os.Setenv("DOCKER_BUILDKIT", "1")
+		cacheArgs += "--build-arg BUILDKIT_INLINE_CACHE=1 "
+		for _, cachePath := range repoConfig.ImageCacheFromPaths {
+			cacheArgs += fmt.Sprintf("--cache-from %s ", cachePath)
+		}
+		cacheArgs += cacheTagArgs(repoConfig)
+	default:
+		// The classic builder only uses cache images which exist locally, so pull the best match that exists
+		fmt.Println("=> Pulling the cache image (the first one found is the best match).")
+		for _, cachePath := range repoConfig.ImageCacheFromPaths {
+			if DockerImageExistsRemote(cachePath) {
+				fmt.Printf("=> Using cache image: %s\n", cachePath)
+				cacheArgs += fmt.Sprintf("--cache-from %s ", cachePath)
+				break
+			}
+		}
+		cacheArgs += cacheTagArgs(repoConfig)
+	}
+
+	if repoConfig.ImageContentPath != "" {
+		cacheArgs += fmt.Sprintf("-t %s ", repoConfig.ImageContentPath)
+	}
 
 	// Run docker build
-	if exitCode := cli.StreamAndGetCommandExitCode(
+	exitCode := cli.StreamAndGetCommandExitCode(
 		"docker",
-		fmt.Sprintf("build %s --cache-from %s -t %s -t %s %s", buildArgs, repoConfig.ImageCachePath, repoConfig.ImageFullPath, repoConfig.ImageCachePath, repoConfig.PWD),
-		// fmt.Sprintf("build -t %s -t %s %s", repoConfig.ImageFullPath, repoConfig.ImageCachePath, repoConfig.PWD),
-	); exitCode != 0 {
-		os.Exit(1)
+		fmt.Sprintf("%s %s %s-t %s %s", buildCommand, buildArgs, cacheArgs, repoConfig.ImageFullPath, repoConfig.PWD),
+	)
+	removeSecretFiles()
+	if exitCode != 0 {
+		exitWithMetadata(repoConfig)
+	}
+}
+
+// cacheTagArgs tags the build with the cache tags that this branch pushes to
+func cacheTagArgs(repoConfig config.RepoConfigMap) string {
+	tagArgs := fmt.Sprintf("-t %s ", repoConfig.ImageBranchCachePath)
+	if updatesVersionCache(repoConfig) {
+		tagArgs += fmt.Sprintf("-t %s ", repoConfig.ImageCachePath)
+	}
+	return tagArgs
+}
+
+// updatesVersionCache is true if the branch is one of the cache fallback branches,
+// which are the only branches allowed to overwrite the cache shared by all branches
+func updatesVersionCache(repoConfig config.RepoConfigMap) bool {
+	for _, branch := range repoConfig.Build.Cache.FallbackBranches {
+		if branch == repoConfig.GitBranch {
+			return true
+		}
 	}
+	return false
 }
 
 func RunBuildTests(keepTestContainer bool, repoConfig config.RepoConfigMap) {
-	// Start container and run tests
 	tests := repoConfig.Tests
+	dependencies := testSetDependencies(tests)
+
+	// Output is only prefixed with the test set name if more than one test set can be running at the same time
+	concurrent := false
 	for _, testSet := range tests {
-		fmt.Printf("\n\n=> Setting up test set: %s\n", testSet.Name)
-
-		// Start the test container
-		var (
-			containerName string
-			exitCode      int
-		)
-		if testSet.Type != "host-only" { // 'host-only' skips running the test docker container (for env setup)
-			fmt.Printf("=> Starting docker image: %s\n", repoConfig.ImageFullPath)
-
-			var dockerRunCommand string
-			if testSet.DockerArgs != "" {
-				dockerRunCommand = fmt.Sprintf("%s %s", testSet.DockerArgs, repoConfig.ImageFullPath)
-			} else {
-				dockerRunCommand = repoConfig.ImageFullPath
+		if testSet.Parallel || len(testSet.DependsOn) > 0 {
+			concurrent = true
+		}
+	}
+
+	testStartTime := time.Now()
+	done := make([]chan struct{}, len(tests))
+	passed := make([]bool, len(tests))
+	results := make([]TestResult, len(tests))
+	for i := range tests {
+		done[i] = make(chan struct{})
+		results[i] = TestResult{Name: tests[i].Name, Status: "skipped"}
+	}
+
+	// Every test set waits for its dependencies - sets without 'parallel' or 'dependsOn' wait for all the sets before them
+	for i := range tests {
+		go func(i int) {
+			defer close(done[i])
+			prefix := ""
+			if concurrent {
+				prefix = fmt.Sprintf("[%s] ", tests[i].Name)
 			}
-			if testSet.DockerCommand != "" {
-				dockerRunCommand = dockerRunCommand + " " + testSet.DockerCommand
+			for _, d := range dependencies[i] {
+				<-done[d]
+				if !passed[d] {
+					cli.Printf(prefix, "=> Skipping test set '%s', since '%s' did not pass.\n", tests[i].Name, tests[d].Name)
+					return
+				}
 			}
-
-			containerName, exitCode = cli.StreamAndGetCommandOutputAndExitCode("docker",
-				strings.Join([]string{"run", dockerRunCommand}, " "))
-			if exitCode != 0 {
-				teardownTest(containerName, true, keepTestContainer)
+			setStartTime := time.Now()
+			passed[i] = runTestSet(i, tests[i], prefix, keepTestContainer, repoConfig)
+			results[i].DurationSeconds = time.Since(setStartTime).Seconds()
+			results[i].Status = "failed"
+			if passed[i] {
+				results[i].Status = "passed"
 			}
-		}
+		}(i)
+	}
 
-		// Wait two seconds for it to come alive
-		time.Sleep(2 * time.Second)
+	failed := false
+	for i := range tests {
+		<-done[i]
+		if !passed[i] {
+			failed = true
+		}
+	}
+	metadata.Tests = results
+	metadata.TestDurationSeconds = time.Since(testStartTime).Seconds()
+	if failed {
+		fmt.Println("=> Oh no, not all of the test sets passed.")
+		exitWithMetadata(repoConfig)
+	}
+}
 
-		// Run all tests
-		for _, testCommand := range testSet.Commands {
-			// Wait two seconds for it to come alive
-			time.Sleep(2 * time.Second)
-			fmt.Printf("=> Executing test command: %s\n", testCommand)
-			// commandSplit := strings.SplitN(testCommand, " ", 2)
-			// Run the test command
-			switch t := testSet.Type; t {
-			case "on-host", "host-only":
-				commandSplit := strings.SplitN(testCommand, " ", 2)
-				if exitCode := cli.StreamAndGetCommandExitCode(commandSplit[0], commandSplit[1]); exitCode != 0 {
-					teardownTest(containerName, true, keepTestContainer)
-					break
-				}
-			case "in-test-container":
-				if exitCode := cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("exec %s %s", containerName, testCommand)); exitCode != 0 {
-					teardownTest(containerName, true, keepTestContainer)
-					break
-				}
-			case "in-external-container":
-				if exitCode := cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("run --rm --network container:%s %s %s", containerName, testCommandImage, testCommand)); exitCode != 0 {
-					teardownTest(containerName, true, keepTestContainer)
-					break
+// testSetDependencies returns, for each test set, the indexes of the test sets that have to finish before it can start
+func testSetDependencies(tests []config.TestConfigMap) [][]int {
+	dependencies := make([][]int, len(tests))
+	lastSequential := -1
+	for i, testSet := range tests {
+		switch {
+		case len(testSet.DependsOn) > 0:
+			for _, name := range testSet.DependsOn {
+				found := false
+				for d := 0; d < i; d++ {
+					if tests[d].Name == name {
+						dependencies[i] = append(dependencies[i], d)
+						found = true
+					}
 				}
-			default:
-				fmt.Printf("=> Since you didn't specify where to run test %s, I'll run it in an external container (attached to the same network).\n", testCommand)
-				if exitCode := cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("run --rm --network container:%s %s %s", containerName, testCommandImage, testCommand)); exitCode != 0 {
-					teardownTest(containerName, true, keepTestContainer)
+				if !found {
+					fmt.Printf("=> Uh oh, test set '%s' depends on '%s', which isn't a test set defined before it.\n", testSet.Name, name)
+					os.Exit(1)
 				}
 			}
+		case testSet.Parallel:
+			// Parallel test sets still wait for the sequential set before them (eg. a 'host-only' set that starts dependencies)
+			if lastSequential >= 0 {
+				dependencies[i] = []int{lastSequential}
+			}
+		default:
+			for d := 0; d < i; d++ {
+				dependencies[i] = append(dependencies[i], d)
+			}
+			lastSequential = i
 		}
-		teardownTest(containerName, false, keepTestContainer)
 	}
+	return dependencies
 }
 
-func teardownTest(containerName string, exit bool, keepTestContainer bool) {
+func runTestSet(index int, testSet config.TestConfigMap, prefix string, keepTestContainer bool, repoConfig config.RepoConfigMap) bool {
+	cli.Printf(prefix, "\n\n=> Setting up test set: %s\n", testSet.Name)
+
+	// Test sets which can run alongside others get their own container name and docker network, so they can't collide
+	var testNetwork, testContainerName string
+	if (testSet.Parallel || len(testSet.DependsOn) > 0) && testSet.Type != "host-only" {
+		uniqueName := invalidDockerNameCharRegex.ReplaceAllString(
+			fmt.Sprintf("kd-test-%.25s-%s-%d-%s", repoConfig.Application.Name, repoConfig.GitSHA, index, testSet.Name), "-")
+		if !strings.Contains(testSet.DockerArgs, "--network") && !strings.Contains(testSet.DockerArgs, "--net ") {
+			testNetwork = uniqueName
+			if exitCode := cli.GetCommandExitCode("docker", fmt.Sprintf("network create %s", testNetwork)); exitCode != 0 {
+				cli.Printf(prefix, "=> Uh oh, I couldn't create the docker network %s for this test set.\n", testNetwork)
+				return false
+			}
+		}
+		if !strings.Contains(testSet.DockerArgs, "--name") {
+			testContainerName = uniqueName
+		}
+	}
+
+	// Start the test container
+	var (
+		containerName string
+		exitCode      int
+	)
+	if testSet.Type != "host-only" { // 'host-only' skips running the test docker container (for env setup)
+		cli.Printf(prefix, "=> Starting docker image: %s\n", repoConfig.ImageFullPath)
+
+		dockerRunCommand := repoConfig.ImageFullPath
+		if testSet.DockerArgs != "" {
+			dockerRunCommand = fmt.Sprintf("%s %s", testSet.DockerArgs, dockerRunCommand)
+		}
+		if testNetwork != "" {
+			dockerRunCommand = fmt.Sprintf("--network %s %s", testNetwork, dockerRunCommand)
+		}
+		if testContainerName != "" {
+			dockerRunCommand = fmt.Sprintf("--name %s %s", testContainerName, dockerRunCommand)
+		}
+		if testSet.DockerCommand != "" {
+			dockerRunCommand = dockerRunCommand + " " + testSet.DockerCommand
+		}
+
+		containerName, exitCode = cli.StreamAndGetCommandOutputAndExitCodeWithPrefix(prefix, "docker",
+			strings.Join([]string{"run", dockerRunCommand}, " "))
+		if testContainerName != "" {
+			containerName = testContainerName
+		}
+		if exitCode != 0 {
+			teardownTest(containerName, testNetwork, prefix, keepTestContainer)
+			return false
+		}
+	}
+
+	// Wait two seconds for it to come alive
+	time.Sleep(2 * time.Second)
+
+	// Run all tests
+	for _, testCommand := range testSet.Commands {
+		// Wait two seconds for it to come alive
+		time.Sleep(2 * time.Second)
+		cli.Printf(prefix, "=> Executing test command: %s\n", testCommand)
+		// Run the test command
+		var exitCode int
+		switch t := testSet.Type; t {
+		case "on-host", "host-only":
+			commandSplit := strings.SplitN(testCommand, " ", 2)
+			exitCode = cli.StreamAndGetCommandExitCodeWithPrefix(prefix, commandSplit[0], commandSplit[1])
+		case "in-test-container":
+			exitCode = cli.StreamAndGetCommandExitCodeWithPrefix(prefix, "docker", fmt.Sprintf("exec %s %s", containerName, testCommand))
+		case "in-external-container":
+			exitCode = cli.StreamAndGetCommandExitCodeWithPrefix(prefix, "docker", fmt.Sprintf("run --rm --network container:%s %s %s", containerName, testCommandImage, testCommand))
+		default:
+			cli.Printf(prefix, "=> Since you didn't specify where to run test %s, I'll run it in an external container (attached to the same network).\n", testCommand)
+			exitCode = cli.StreamAndGetCommandExitCodeWithPrefix(prefix, "docker", fmt.Sprintf("run --rm --network container:%s %s %s", containerName, testCommandImage, testCommand))
+		}
+		if exitCode != 0 {
+			teardownTest(containerName, testNetwork, prefix, keepTestContainer)
+			return false
+		}
+	}
+	teardownTest(containerName, testNetwork, prefix, keepTestContainer)
+	return true
+}
+
+func teardownTest(containerName string, networkName string, prefix string, keepTestContainer bool) {
 	if containerName != "" {
-		fmt.Println("=> Stopping test container.")
+		cli.Printf(prefix, "=> Stopping test container.\n")
 		cli.GetCommandOutput("docker", fmt.Sprintf("stop %s", containerName))
 		if keepTestContainer {
-			fmt.Println("=> Leaving the test container without deleting, like you asked.")
-		} else {
-			fmt.Println("=> Removing test container.")
-			cli.GetCommandOutput("docker", fmt.Sprintf("rm %s", containerName))
+			cli.Printf(prefix, "=> Leaving the test container without deleting, like you asked.\n")
+			return
 		}
+		cli.Printf(prefix, "=> Removing test container.\n")
+		cli.GetCommandOutput("docker", fmt.Sprintf("rm %s", containerName))
 	}
-	if exit {
-		os.Exit(1)
+	if networkName != "" {
+		cli.GetCommandOutput("docker", fmt.Sprintf("network rm %s", networkName))
 	}
 }
 
 func askPushDockerImage(repoConfig config.RepoConfigMap) int {
-	fmt.Print("=> Yay, all the tests passed! Would you like to push this to the remote now?\n=> Press 'y' to push, anything else to exit.\n>>> ") // TODO - make this pluggable
-	reader := bufio.NewReader(os.Stdin)
-	confirm, _ := reader.ReadString('\n')
-	if confirm != "y\n" && confirm != "Y" {
+	push, err := cli.Ask("push-image", "Yay, all the checks passed! Would you like to push this to the remote now?")
+	if err != nil {
+		// Not pushing the image isn't a success when nobody decided that
+		fmt.Printf("=> Oh no! %s\n", err)
+		removeKanikoStagingImage(repoConfig)
+		exitWithMetadata(repoConfig)
+	}
+	if !push {
+		removeKanikoStagingImage(repoConfig)
+		// The image was built and checked, so CI still gets the results, with 'pushed: false'
+		WriteMetadataFile(repoConfig)
 		fmt.Println("=> Thanks for building, Bob!")
 		os.Exit(0)
 	}
@@ -187,8 +413,17 @@ func askPushDockerImage(repoConfig config.RepoConfigMap) int {
 }
 
 func forcePushDockerImage(repoConfig config.RepoConfigMap) int {
+	if repoConfig.Build.Backend == "kaniko" {
+		return pushKanikoBuild(repoConfig)
+	}
 	pushCode := cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("push %s", repoConfig.ImageFullPath))
-	if pushCode != 0 {
+	if pushCode == 0 && repoConfig.ImageContentPath != "" {
+		pushCode = cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("push %s", repoConfig.ImageContentPath))
+	}
+	if pushCode != 0 || repoConfig.Build.Cache.Mode == "registry" { // the registry cache was already exported during the build
+		return pushCode
+	}
+	if pushCode = cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("push %s", repoConfig.ImageBranchCachePath)); pushCode != 0 || !updatesVersionCache(repoConfig) {
 		return pushCode
 	}
 	return cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("push %s", repoConfig.ImageCachePath))
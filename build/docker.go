@@ -9,6 +9,8 @@ import (
 	"text/tabwriter"
 
 	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/config"
+	"github.com/mycujoo/kube-deploy/registry"
 )
 
 type gcloudDockerTag struct {
@@ -44,6 +46,68 @@ func DockerListTags(imageName string) {
 	w.Flush()
 }
 
+// PromoteImage copies an image which was already built and tested in the development repository to the production
+// repository, through the registry API. Without a source tag, it looks for an image built from the current commit.
+func PromoteImage(sourceTag string, targetTag string, repoConfig config.RepoConfigMap) {
+	if sourceTag == "" {
+		sourceTag = findTagForCommit(repoConfig.DevelopmentImageName, repoConfig)
+	}
+	if targetTag == "" {
+		targetTag = repoConfig.ImageTag
+	}
+
+	// Branches pushing to the development repository still promote to the production repository
+	targetImageName := repoConfig.ImageName
+	if repoConfig.DockerRepositoryName == repoConfig.DockerRepository.DevelopmentRepositoryName {
+		targetImageName = repoConfig.ProductionImageName
+	}
+
+	sourceImage := fmt.Sprintf("%s:%s", repoConfig.DevelopmentImageName, sourceTag)
+	targetImage := fmt.Sprintf("%s:%s", targetImageName, targetTag)
+	fmt.Printf("=> Promoting image:\n\tfrom: %s\n\tto:   %s\n", sourceImage, targetImage)
+
+	digest, err := registry.CopyImage(sourceImage, targetImage)
+	if err != nil {
+		fmt.Printf("=> Oh no, promoting the image failed: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("=> Done! The promoted image has the digest %s.\n", digest)
+}
+
+// findTagForCommit looks for a tag in the repository which was built from the current commit (by any branch)
+func findTagForCommit(imageName string, repoConfig config.RepoConfigMap) string {
+	fmt.Printf("=> Looking for an image of version %s built from commit %s in %s.\n", repoConfig.Application.Version, repoConfig.GitSHA, imageName)
+	tags, err := registry.ListTags(imageName)
+	if err != nil {
+		fmt.Printf("=> Oh no, I couldn't list the tags of %s: %s\n", imageName, err)
+		os.Exit(1)
+	}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, repoConfig.Application.Version+"-") && strings.HasSuffix(tag, "-"+repoConfig.GitSHA) {
+			return tag
+		}
+	}
+	fmt.Println("=> Sorry, there is no image for this commit yet. Build it on a development branch first, or pass the tag to promote.")
+	os.Exit(1)
+	return ""
+}
+
+// ResolveImageDigest looks up the digest of the pushed image, and exposes it as 'KD_IMAGE_DIGEST' and 'KD_IMAGE_REF'
+// to the Kubernetes templates, so that deployments can't change if someone pushes the same tag again
+func ResolveImageDigest(repoConfig *config.RepoConfigMap) error {
+	digest, err := registry.ManifestDigest(repoConfig.ImageFullPath)
+	if err != nil {
+		return fmt.Errorf("couldn't find the digest of %s: %v", repoConfig.ImageFullPath, err)
+	}
+
+	repoConfig.ImageDigest = digest
+	repoConfig.ImageRef = fmt.Sprintf("%s@%s", repoConfig.ImageName, digest)
+	repoConfig.EnvVarsMap["KD_IMAGE_DIGEST"] = repoConfig.ImageDigest
+	repoConfig.EnvVarsMap["KD_IMAGE_REF"] = repoConfig.ImageRef
+	fmt.Printf("=> The image %s has the digest %s.\n", repoConfig.ImageFullPath, digest)
+	return nil
+}
+
 func DockerImageExistsLocal(imageName string) bool {
 	exitCode := cli.GetCommandExitCode("docker", fmt.Sprintf("inspect %s", imageName))
 
@@ -0,0 +1,154 @@
+package build
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+type gitCheck struct {
+	name    string
+	enabled bool
+	run     func() error
+}
+
+// runGitChecksOrExit runs the configured checks on the git repository, skipping the ones named in skipGitChecks
+// (which are recorded in the build metadata), and exits if any of the others fail
+func runGitChecksOrExit(skipGitChecks []string, repoConfig config.RepoConfigMap) {
+	gitChecks := repoConfig.Build.GitChecks
+	if repoConfig.ClusterName != "production" && !gitChecks.AllBranches {
+		return
+	}
+
+	fetched := false
+	fetch := func() error {
+		if !fetched {
+			if output, exitCode := cli.GetQuietCommandOutputAndExitCode("git", "fetch --quiet"); exitCode != 0 {
+				return fmt.Errorf("I couldn't fetch from the remote to compare with it:\n%s", output)
+			}
+			fetched = true
+		}
+		return nil
+	}
+
+	checks := []gitCheck{
+		{"clean", true, checkNoUncommittedChanges},
+		{"untracked", gitChecks.NoUntrackedFiles == nil || *gitChecks.NoUntrackedFiles, checkNoUntrackedFiles},
+		{"pushed", gitChecks.Pushed, func() error { return checkHeadIsPushed(fetch) }},
+		{"behind", gitChecks.NotBehindUpstream, func() error { return checkNotBehindUpstream(fetch) }},
+		{"signed", gitChecks.SignedCommits, checkHeadIsSigned},
+		{"tagged", gitChecks.Tagged, checkHeadIsTagged},
+	}
+
+	for _, name := range skipGitChecks {
+		known := false
+		for _, check := range checks {
+			known = known || check.name == name
+		}
+		if !known {
+			fmt.Printf("=> Uh oh, there is no git check called '%s' to skip.\n", name)
+			exitWithMetadata(repoConfig)
+		}
+	}
+
+	fmt.Println("=> Checking the git repository before building.")
+	failed := false
+	for _, check := range checks {
+		if !check.enabled {
+			continue
+		}
+		if isSkipped(check.name, skipGitChecks) {
+			fmt.Printf("=> Skipping the git check '%s', like you asked. This is recorded in the build metadata.\n", check.name)
+			metadata.SkippedGitChecks = append(metadata.SkippedGitChecks, check.name)
+			continue
+		}
+		if err := check.run(); err != nil {
+			fmt.Printf("=> Oh no! The git check '%s' failed: %s\n", check.name, err)
+			failed = true
+		}
+	}
+	if failed {
+		fmt.Println("=> If you're really, really sure, you can skip a check with the '--skip-git-check <name>' flag.")
+		exitWithMetadata(repoConfig)
+	}
+}
+
+func isSkipped(name string, skipGitChecks []string) bool {
+	for _, skipped := range skipGitChecks {
+		if skipped == name {
+			return true
+		}
+	}
+	return false
+}
+
+func checkNoUncommittedChanges() error {
+	if changes := strings.TrimSpace(cli.GetCommandOutput("git", "status --porcelain --untracked-files=no")); changes != "" {
+		return fmt.Errorf("there are uncommitted changes in the working tree - please commit or stash them:\n%s", changes)
+	}
+	return nil
+}
+
+func checkNoUntrackedFiles() error {
+	if untracked := strings.TrimSpace(cli.GetCommandOutput("git", "ls-files --others --exclude-standard")); untracked != "" {
+		return fmt.Errorf("there are untracked files, which would end up in the build context - please commit, remove or ignore them:\n%s", untracked)
+	}
+	return nil
+}
+
+func checkHeadIsPushed(fetch func() error) error {
+	if err := fetch(); err != nil {
+		return err
+	}
+	if remoteBranches := strings.TrimSpace(cli.GetCommandOutput("git", "branch --remotes --contains HEAD")); remoteBranches == "" {
+		return fmt.Errorf("HEAD isn't on any remote branch, so nobody else can see what's being built - please push it first")
+	}
+	return nil
+}
+
+func checkNotBehindUpstream(fetch func() error) error {
+	upstream, exitCode := cli.GetQuietCommandOutputAndExitCode("git", "rev-parse --abbrev-ref --symbolic-full-name @{upstream}")
+	if exitCode != 0 {
+		return fmt.Errorf("the branch has no upstream branch to compare with - set one with 'git push --set-upstream'")
+	}
+	if err := fetch(); err != nil {
+		return err
+	}
+	behind, err := strconv.Atoi(strings.TrimSpace(cli.GetCommandOutput("git", "rev-list --count HEAD..@{upstream}")))
+	if err != nil {
+		return fmt.Errorf("I couldn't count the commits on %s: %v", strings.TrimSpace(upstream), err)
+	}
+	if behind > 0 {
+		return fmt.Errorf("the branch is %d commit(s) behind %s, so it would build without them - please pull first", behind, strings.TrimSpace(upstream))
+	}
+	return nil
+}
+
+func checkHeadIsSigned() error {
+	switch status := strings.TrimSpace(cli.GetCommandOutput("git", "log -1 --format=%G? HEAD")); status {
+	case "G", "U":
+		return nil
+	case "N":
+		return fmt.Errorf("HEAD isn't signed - sign it with 'git commit --amend --gpg-sign'")
+	case "B":
+		return fmt.Errorf("HEAD has a bad signature")
+	case "E":
+		return fmt.Errorf("the signature of HEAD can't be checked, probably because the public key is missing")
+	case "X", "Y":
+		return fmt.Errorf("HEAD was signed with an expired signature or key")
+	case "R":
+		return fmt.Errorf("HEAD was signed with a revoked key")
+	default:
+		return fmt.Errorf("git reported the unknown signature status '%s' for HEAD", status)
+	}
+}
+
+func checkHeadIsTagged() error {
+	if _, exitCode := cli.GetQuietCommandOutputAndExitCode("git", "describe --exact-match --tags HEAD"); exitCode != 0 {
+		return fmt.Errorf("HEAD doesn't match a tag - tag the release (and push the tag) first")
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/config"
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/registry"
+)
+
+// builtImagePath is where the build puts the image before it's pushed. Kaniko can only push to a registry,
+// so it pushes to a staging tag which is copied to the real tags once the image passed the scan.
+func builtImagePath(repoConfig config.RepoConfigMap) string {
+	if repoConfig.Build.Backend == "kaniko" {
+		return repoConfig.ImageFullPath + "-unverified"
+	}
+	return repoConfig.ImageFullPath
+}
+
+// ImageExistsRemote checks whether the image was already pushed (through the registry API if there's no docker daemon)
+func ImageExistsRemote(imageName string, repoConfig config.RepoConfigMap) bool {
+	if repoConfig.Build.Backend != "kaniko" {
+		return DockerImageExistsRemote(imageName)
+	}
+	exists, err := registry.ImageExists(imageName)
+	if err != nil {
+		fmt.Printf("=> Couldn't check the registry for %s: %s\n", imageName, err)
+	}
+	return exists
+}
+
+// makeKanikoBuild uploads the build context and runs Kaniko as a job in the cluster, which pushes to the staging tag
+func makeKanikoBuild(repoConfig config.RepoConfigMap) {
+	kaniko := repoConfig.Build.Kaniko
+
+	fmt.Println("=> Okay, let's start the build process in the cluster with Kaniko!")
+	fmt.Printf("=> The image will be pushed to %s until it's verified.\n\n", builtImagePath(repoConfig))
+
+	contextFile, err := packBuildContext(repoConfig.PWD)
+	if err != nil {
+		fmt.Printf("=> Oh no, packing up the build context failed: %s\n", err)
+		exitWithMetadata(repoConfig)
+	}
+	defer os.Remove(contextFile)
+
+	jobName := invalidDockerNameCharRegex.ReplaceAllString(
+		strings.ToLower(fmt.Sprintf("kaniko-%.30s-%s", repoConfig.Application.Name, repoConfig.GitSHA)), "-")
+	contextURL := fmt.Sprintf("%s/%s.tar.gz", strings.TrimSuffix(kaniko.ContextBucket, "/"), jobName)
+
+	fmt.Printf("=> Uploading the build context to %s\n", contextURL)
+	copyCommand, removeCommand := "gsutil", "gsutil"
+	if strings.HasPrefix(contextURL, "s3://") {
+		copyCommand, removeCommand = "aws", "aws"
+	}
+	copyArgs, removeArgs := fmt.Sprintf("cp %s %s", contextFile, contextURL), fmt.Sprintf("rm %s", contextURL)
+	if copyCommand == "aws" {
+		copyArgs, removeArgs = "s3 "+copyArgs, "s3 "+removeArgs
+	}
+	if exitCode := cli.StreamAndGetCommandExitCode(copyCommand, copyArgs); exitCode != 0 {
+		fmt.Println("=> Oh no, uploading the build context failed.")
+		exitWithMetadata(repoConfig)
+	}
+	defer cli.GetCommandExitCode(removeCommand, removeArgs)
+
+	succeeded, err := kubeapi.RunJob(kaniko.Namespace, kanikoJob(jobName, contextURL, repoConfig), "")
+	kubeapi.DeleteJob(kaniko.Namespace, jobName)
+	if err != nil {
+		fmt.Printf("=> Oh no, %s\n", err)
+		exitWithMetadata(repoConfig)
+	}
+	if !succeeded {
+		fmt.Println("=> Oh no, the Kaniko build failed.")
+		exitWithMetadata(repoConfig)
+	}
+}
+
+func kanikoJob(jobName string, contextURL string, repoConfig config.RepoConfigMap) *batchv1.Job {
+	kaniko := repoConfig.Build.Kaniko
+
+	args := []string{
+		"--context=" + contextURL,
+		"--dockerfile=Dockerfile",
+		"--destination=" + builtImagePath(repoConfig),
+		fmt.Sprintf("--label=%s=%s", testsLabel, testsOutcome(repoConfig)),
+	}
+	if repoConfig.Application.ExposeBuildArgs {
+		for key, value := range exposedBuildArgs(repoConfig) {
+			args = append(args, fmt.Sprintf("--build-arg=%s=%s", key, value))
+		}
+		fmt.Println("=> Exposing ALL branch variables as build arguments")
+	}
+	if kaniko.CacheRepo != "" {
+		args = append(args, "--cache=true", "--cache-repo="+kaniko.CacheRepo)
+	}
+
+	backoffLimit := int32(0)
+	container := v1.Container{
+		Name:  "kaniko",
+		Image: kaniko.Image,
+		Args:  args,
+	}
+	podSpec := v1.PodSpec{
+		RestartPolicy:      v1.RestartPolicyNever,
+		ServiceAccountName: kaniko.ServiceAccount,
+	}
+	if kaniko.DockerConfigSecret != "" {
+		// Kaniko reads the registry login from a docker config file, just like docker does
+		podSpec.Volumes = []v1.Volume{{
+			Name: "docker-config",
+			VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{
+				SecretName: kaniko.DockerConfigSecret,
+				Items:      []v1.KeyToPath{{Key: ".dockerconfigjson", Path: "config.json"}},
+			}},
+		}}
+		container.VolumeMounts = []v1.VolumeMount{{Name: "docker-config", MountPath: "/kaniko/.docker"}}
+	}
+	podSpec.Containers = []v1.Container{container}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: jobName,
+			Labels: map[string]string{
+				"app":              "kube-deploy-kaniko",
+				"kubedeploy-build": repoConfig.ReleaseName,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: &kaniko.TimeoutSeconds,
+			Template:              v1.PodTemplateSpec{Spec: podSpec},
+		},
+	}
+}
+
+// pushKanikoBuild copies the verified image from the staging tag to its real tags, through the registry API, and
+// removes the staging tag. Without its test sets, the image doesn't get the content tag, so no other branch reuses it.
+func pushKanikoBuild(repoConfig config.RepoConfigMap) int {
+	defer removeKanikoStagingImage(repoConfig)
+	for _, target := range []string{repoConfig.ImageFullPath, repoConfig.ImageContentPath} {
+		if target == "" {
+			continue
+		}
+		if target == repoConfig.ImageContentPath && testsOutcome(repoConfig) == "skipped" {
+			fmt.Printf("=> Not pushing %s, since the test sets were skipped.\n", target)
+			continue
+		}
+		fmt.Printf("=> Pushing %s\n", target)
+		if _, err := registry.CopyImage(builtImagePath(repoConfig), target); err != nil {
+			fmt.Printf("=> Oh no, pushing the image failed: %s\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// removeKanikoStagingImage deletes the staging tag of a Kaniko build. Only the tag is deleted, since the manifest
+// is the same one the real tags point to.
+func removeKanikoStagingImage(repoConfig config.RepoConfigMap) {
+	if repoConfig.Build.Backend != "kaniko" {
+		return
+	}
+	if err := registry.DeleteTag(builtImagePath(repoConfig)); err != nil {
+		fmt.Printf("=> Heads up: couldn't remove the staging tag %s, so you'll need to remove it yourself: %s\n", builtImagePath(repoConfig), err)
+	}
+}
+
+// packBuildContext writes the directory (without anything matching the .dockerignore file) to a gzipped tarball,
+// which is the format Kaniko expects its build context in
+func packBuildContext(directory string) (string, error) {
+	ignorePatterns := []string{".git"}
+	if ignoreFile, err := os.Open(filepath.Join(directory, ".dockerignore")); err == nil {
+		scanner := bufio.NewScanner(ignoreFile)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				ignorePatterns = append(ignorePatterns, filepath.Clean(line))
+			}
+		}
+		ignoreFile.Close()
+	}
+
+	contextFile, err := ioutil.TempFile("", "kube-deploy-context-*.tar.gz")
+	if err != nil {
+		return "", err
+	}
+	defer contextFile.Close()
+	gzipWriter := gzip.NewWriter(contextFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(directory, path)
+		if err != nil || relativePath == "." {
+			return err
+		}
+		if isIgnored(relativePath, ignorePatterns) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relativePath)
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tarWriter, file)
+		return err
+	})
+	if err == nil {
+		err = tarWriter.Close()
+	}
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	if err != nil {
+		os.Remove(contextFile.Name())
+		return "", err
+	}
+	return contextFile.Name(), nil
+}
+
+// isIgnored applies .dockerignore patterns in order, so a later '!pattern' can include a path again.
+// A pattern matching a directory matches everything inside it.
+func isIgnored(relativePath string, patterns []string) bool {
+	ignored := false
+	for _, pattern := range patterns {
+		exclude := !strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		for path := relativePath; path != "." && path != string(filepath.Separator); path = filepath.Dir(path) {
+			if matched, _ := filepath.Match(pattern, path); matched {
+				ignored = exclude
+				break
+			}
+		}
+	}
+	return ignored
+}
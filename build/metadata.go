@@ -0,0 +1,94 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+// BuildMetadata : the details of a build, written to the '--metadata-file' for later CI steps to consume
+type BuildMetadata struct {
+	ImageName            string       `json:"imageName"`
+	ImageTag             string       `json:"imageTag"`
+	ImageFullPath        string       `json:"imageFullPath"`
+	ImageDigest          string       `json:"imageDigest"`
+	ImageRef             string       `json:"imageRef"`
+	CachePath            string       `json:"cachePath"`
+	GitSHA               string       `json:"gitSHA"`
+	GitBranch            string       `json:"gitBranch"`
+	BuildDurationSeconds float64      `json:"buildDurationSeconds"`
+	TestDurationSeconds  float64      `json:"testDurationSeconds"`
+	SkippedGitChecks     []string     `json:"skippedGitChecks"`
+	Tests                []TestResult `json:"tests"`
+	Reused               bool         `json:"reused"` // an image with the same content was tagged instead of building
+	Pushed               bool         `json:"pushed"`
+}
+
+// TestResult : the outcome of a single test set
+type TestResult struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"` // 'passed', 'failed' or 'skipped'
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+var metadataFile string
+var metadata = BuildMetadata{Tests: []TestResult{}, SkippedGitChecks: []string{}}
+
+// SetMetadataFile makes the build write its metadata to the given path, both when it finishes and when it fails
+func SetMetadataFile(path string) {
+	metadataFile = path
+}
+
+// WriteMetadataFile writes what has been collected about the build so far, if a metadata file was set
+func WriteMetadataFile(repoConfig config.RepoConfigMap) {
+	if metadataFile == "" {
+		return
+	}
+
+	metadata.ImageName = repoConfig.ImageName
+	metadata.ImageTag = repoConfig.ImageTag
+	metadata.ImageFullPath = repoConfig.ImageFullPath
+	metadata.ImageDigest = repoConfig.ImageDigest
+	metadata.ImageRef = repoConfig.ImageRef
+	metadata.CachePath = repoConfig.ImageBranchCachePath
+	metadata.GitSHA = repoConfig.GitSHA
+	metadata.GitBranch = repoConfig.GitBranch
+
+	jsonBytes, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		panic(err.Error())
+	}
+	if err := ioutil.WriteFile(metadataFile, jsonBytes, 0644); err != nil {
+		fmt.Printf("=> Uh oh, I couldn't write the build metadata file: %s\n", err)
+		return
+	}
+	fmt.Printf("=> Wrote the build metadata to %s.\n", metadataFile)
+}
+
+// ReadMetadataFile reads the metadata of an earlier build, which has to be for the current commit
+func ReadMetadataFile(path string, repoConfig config.RepoConfigMap) (BuildMetadata, error) {
+	previous := BuildMetadata{}
+	fileBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return previous, err
+	}
+	if err := json.Unmarshal(fileBytes, &previous); err != nil {
+		return previous, fmt.Errorf("couldn't parse the build metadata file %s: %v", path, err)
+	}
+	if previous.ImageFullPath != repoConfig.ImageFullPath {
+		return previous, fmt.Errorf("the build metadata file %s is for the image %s, not %s", path, previous.ImageFullPath, repoConfig.ImageFullPath)
+	}
+	if previous.ImageDigest == "" {
+		return previous, fmt.Errorf("the build metadata file %s has no image digest, so the image was never pushed", path)
+	}
+	return previous, nil
+}
+
+// exitWithMetadata records the failed build in the metadata file before exiting
+func exitWithMetadata(repoConfig config.RepoConfigMap) {
+	WriteMetadataFile(repoConfig)
+	os.Exit(1)
+}
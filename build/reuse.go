@@ -0,0 +1,68 @@
+package build
+
+import (
+	"fmt"
+
+	"github.com/mycujoo/kube-deploy/config"
+	"github.com/mycujoo/kube-deploy/registry"
+)
+
+// reuseImageByContent looks for an image built from exactly the same content (on any branch, in any of the
+// repositories), and tags it with this build's image tag instead of building and testing it again
+func reuseImageByContent(skipScan bool, skipTests bool, repoConfig config.RepoConfigMap) bool {
+	if repoConfig.ImageContentTag == "" {
+		fmt.Println("=> The working directory has uncommitted changes, so I can't look for an image with the same content.")
+		return false
+	}
+
+	fmt.Printf("=> Looking for an existing image with the same content (tag %s).\n", repoConfig.ImageContentTag)
+	candidates := []string{repoConfig.ImageName}
+	for _, imageName := range []string{repoConfig.DevelopmentImageName, repoConfig.ProductionImageName} {
+		if imageName != repoConfig.ImageName {
+			candidates = append(candidates, imageName)
+		}
+	}
+
+	for _, imageName := range candidates {
+		existingImage := fmt.Sprintf("%s:%s", imageName, repoConfig.ImageContentTag)
+		exists, err := registry.ImageExists(existingImage)
+		if err != nil {
+			fmt.Printf("=> Couldn't check for the image %s, so I'll skip it: %s\n", existingImage, err)
+			continue
+		}
+		if !exists {
+			continue
+		}
+		if testsRequired(skipTests, repoConfig) {
+			labels, err := registry.ImageLabels(existingImage)
+			if err != nil {
+				fmt.Printf("=> Couldn't check how the tests of %s went, so I'll skip it: %s\n", existingImage, err)
+				continue
+			}
+			if labels[testsLabel] != "passed" {
+				fmt.Printf("=> Found %s, but it wasn't built with its test sets passing, so I can't use it here.\n", existingImage)
+				continue
+			}
+		}
+
+		fmt.Printf("=> Found %s, so I'll tag that instead of building it again.\n", existingImage)
+		// The image might come from a branch which didn't have to pass the scan, so scan it before it gets this branch's tag
+		if scanRequired(repoConfig) {
+			scanImageOrExit(existingImage, skipScan, repoConfig)
+		}
+		targets := []string{repoConfig.ImageFullPath}
+		if imageName != repoConfig.ImageName {
+			targets = append(targets, repoConfig.ImageContentPath)
+		}
+		for _, target := range targets {
+			if _, err := registry.CopyImage(existingImage, target); err != nil {
+				fmt.Printf("=> Uh oh, tagging the image as %s failed, so I'll build it after all: %s\n", target, err)
+				return false
+			}
+		}
+		return true
+	}
+
+	fmt.Println("=> No image with the same content exists yet.")
+	return false
+}
@@ -0,0 +1,196 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+var severityLevels = map[string]int{
+	"UNKNOWN":    0,
+	"NEGLIGIBLE": 0,
+	"LOW":        1,
+	"MEDIUM":     2,
+	"HIGH":       3,
+	"CRITICAL":   4,
+}
+
+type vulnerability struct {
+	ID               string
+	Severity         string
+	Package          string
+	InstalledVersion string
+}
+
+// scanRequired is true if the image can't be pushed without passing the vulnerability scan
+func scanRequired(repoConfig config.RepoConfigMap) bool {
+	return repoConfig.Build.Scan.Required || repoConfig.ClusterName == "production"
+}
+
+// scanImageOrExit runs the configured vulnerability scanner against the image, and exits if it finds
+// anything at or above the severity threshold which isn't in the allowlist
+func scanImageOrExit(imageName string, skipScan bool, repoConfig config.RepoConfigMap) {
+	scan := repoConfig.Build.Scan
+	if scan.Command == "" {
+		if scanRequired(repoConfig) {
+			fmt.Println("=> Oh no! Images for this branch have to pass a vulnerability scan, but there's no 'build.scan.command' configured.")
+			os.Exit(1)
+		}
+		return
+	}
+	if skipScan {
+		if scanRequired(repoConfig) {
+			fmt.Println("=> Sorry, the vulnerability scan can't be skipped for this branch.")
+			os.Exit(1)
+		}
+		fmt.Println("=> Skipping the vulnerability scan, like you asked.")
+		return
+	}
+
+	threshold := strings.ToUpper(scan.SeverityThreshold)
+	if threshold == "" {
+		threshold = "HIGH"
+	}
+	if _, ok := severityLevels[threshold]; !ok {
+		fmt.Printf("=> Unknown severity threshold '%s' - use one of LOW, MEDIUM, HIGH or CRITICAL.\n", scan.SeverityThreshold)
+		os.Exit(1)
+	}
+
+	fmt.Printf("\n=> Scanning %s for vulnerabilities (blocking on %s and above).\n", imageName, threshold)
+	commandSplit := strings.SplitN(scan.Command, " ", 2)
+	commandArgs := imageName
+	if len(commandSplit) == 2 {
+		commandArgs = commandSplit[1] + " " + imageName
+	}
+	report, exitCode := cli.GetCommandStdoutAndExitCode(commandSplit[0], commandArgs)
+
+	format := scan.Format
+	if format == "" {
+		format = filepath.Base(commandSplit[0])
+	}
+	vulnerabilities, err := parseScanReport(format, []byte(report))
+	if err != nil {
+		fmt.Printf("=> Uh oh, I couldn't read the report of the vulnerability scanner (exit code %d): %s\n", exitCode, err)
+		os.Exit(1)
+	}
+
+	allowlist := readAllowlist(repoConfig)
+	var blocking []vulnerability
+	allowed := 0
+	for _, v := range vulnerabilities {
+		if severityLevels[strings.ToUpper(v.Severity)] < severityLevels[threshold] {
+			continue
+		}
+		if allowlist[v.ID] {
+			allowed++
+			continue
+		}
+		blocking = append(blocking, v)
+	}
+
+	if allowed > 0 {
+		fmt.Printf("=> Ignoring %d finding(s) which are in the allowlist.\n", allowed)
+	}
+	if len(blocking) == 0 {
+		fmt.Printf("=> The vulnerability scan passed (%d finding(s) in total).\n", len(vulnerabilities))
+		return
+	}
+
+	sort.Slice(blocking, func(i, j int) bool {
+		return severityLevels[strings.ToUpper(blocking[i].Severity)] > severityLevels[strings.ToUpper(blocking[j].Severity)]
+	})
+	fmt.Printf("=> Oh no! The vulnerability scan found %d finding(s) at or above %s:\n", len(blocking), threshold)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tID\tSeverity\tPackage\tInstalled Version")
+	for _, v := range blocking {
+		fmt.Fprintf(w, "\t%s\t%s\t%s\t%s\n", v.ID, v.Severity, v.Package, v.InstalledVersion)
+	}
+	w.Flush()
+	fmt.Println("=> Fix them, or (if you have accepted the risk) add their IDs to the allowlist file.")
+	exitWithMetadata(repoConfig)
+}
+
+func parseScanReport(format string, report []byte) ([]vulnerability, error) {
+	var vulnerabilities []vulnerability
+
+	switch format {
+	case "trivy":
+		type trivyResult struct {
+			Vulnerabilities []struct {
+				VulnerabilityID  string
+				PkgName          string
+				InstalledVersion string
+				Severity         string
+			}
+		}
+		// Newer versions of trivy wrap the results in an object, older ones print a list of results
+		var results []trivyResult
+		if strings.HasPrefix(strings.TrimSpace(string(report)), "[") {
+			if err := json.Unmarshal(report, &results); err != nil {
+				return nil, err
+			}
+		} else {
+			wrapped := struct{ Results []trivyResult }{}
+			if err := json.Unmarshal(report, &wrapped); err != nil {
+				return nil, err
+			}
+			results = wrapped.Results
+		}
+		for _, r := range results {
+			for _, v := range r.Vulnerabilities {
+				vulnerabilities = append(vulnerabilities, vulnerability{v.VulnerabilityID, v.Severity, v.PkgName, v.InstalledVersion})
+			}
+		}
+	case "grype":
+		grypeReport := struct {
+			Matches []struct {
+				Vulnerability struct {
+					ID       string `json:"id"`
+					Severity string `json:"severity"`
+				} `json:"vulnerability"`
+				Artifact struct {
+					Name    string `json:"name"`
+					Version string `json:"version"`
+				} `json:"artifact"`
+			} `json:"matches"`
+		}{}
+		if err := json.Unmarshal(report, &grypeReport); err != nil {
+			return nil, err
+		}
+		for _, m := range grypeReport.Matches {
+			vulnerabilities = append(vulnerabilities, vulnerability{m.Vulnerability.ID, m.Vulnerability.Severity, m.Artifact.Name, m.Artifact.Version})
+		}
+	default:
+		return nil, fmt.Errorf("unknown scanner report format '%s' (set 'build.scan.format' to 'trivy' or 'grype')", format)
+	}
+
+	return vulnerabilities, nil
+}
+
+// readAllowlist reads the accepted vulnerability IDs - one per line, with '#' starting a comment
+func readAllowlist(repoConfig config.RepoConfigMap) map[string]bool {
+	allowlist := map[string]bool{}
+	if repoConfig.Build.Scan.AllowlistFile == "" {
+		return allowlist
+	}
+
+	allowlistFile, err := ioutil.ReadFile(filepath.Join(repoConfig.PWD, repoConfig.Build.Scan.AllowlistFile))
+	if err != nil {
+		fmt.Println("=> Uh oh, I couldn't read the vulnerability allowlist file:", err)
+		os.Exit(1)
+	}
+	for _, line := range strings.Split(string(allowlistFile), "\n") {
+		if id := strings.TrimSpace(strings.SplitN(line, "#", 2)[0]); id != "" {
+			allowlist[id] = true
+		}
+	}
+	return allowlist
+}
@@ -0,0 +1,86 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+// exposedBuildArgs returns the branch variables which are passed as build arguments, leaving out the build secrets.
+// Build arguments end up in the image history, so it warns about any of them that still contain a secret's value.
+func exposedBuildArgs(repoConfig config.RepoConfigMap) map[string]string {
+	buildArgs := map[string]string{}
+	if !repoConfig.Application.ExposeBuildArgs {
+		return buildArgs
+	}
+	for key, value := range repoConfig.EnvVarsMap {
+		if repoConfig.Build.IsSecretVariable(key) {
+			fmt.Printf("=> Heads up: %s is a build secret, so it isn't exposed as a build argument.\n", key)
+			continue
+		}
+		buildArgs[key] = value
+	}
+
+	for _, secret := range repoConfig.Build.Secrets {
+		secretValue := repoConfig.EnvVarsMap[secret.Variable]
+		if secret.File != "" || secretValue == "" {
+			continue
+		}
+		for key, value := range buildArgs {
+			if strings.Contains(value, secretValue) {
+				fmt.Printf("=> WARNING: the build argument %s contains the value of the build secret '%s', so it will end up in the image history!\n", key, secret.ID)
+			}
+		}
+	}
+	return buildArgs
+}
+
+// secretBuildArgs writes the values of the build secrets to temporary files, and returns the BuildKit arguments
+// mounting them (and forwarding SSH), along with a function which removes the files again
+func secretBuildArgs(repoConfig config.RepoConfigMap) (string, func()) {
+	args := ""
+	var tempFiles []string
+	cleanup := func() {
+		for _, tempFile := range tempFiles {
+			os.Remove(tempFile)
+		}
+	}
+
+	for _, secret := range repoConfig.Build.Secrets {
+		source := secret.File
+		if source == "" {
+			value, ok := repoConfig.EnvVarsMap[secret.Variable]
+			if !ok {
+				cleanup()
+				fmt.Printf("=> Oh no, the build secret '%s' needs the branch variable %s, which isn't set for this branch.\n", secret.ID, secret.Variable)
+				exitWithMetadata(repoConfig)
+			}
+			secretFile, err := ioutil.TempFile("", "kube-deploy-secret-")
+			if err == nil {
+				tempFiles = append(tempFiles, secretFile.Name())
+				_, err = secretFile.WriteString(value)
+				secretFile.Close()
+			}
+			if err != nil {
+				cleanup()
+				fmt.Printf("=> Oh no, I couldn't write the build secret '%s' to a temporary file: %s\n", secret.ID, err)
+				exitWithMetadata(repoConfig)
+			}
+			source = secretFile.Name()
+		}
+		args += fmt.Sprintf("--secret id=%s,src=%s ", secret.ID, source)
+	}
+
+	for _, ssh := range repoConfig.Build.SSH {
+		if ssh == "default" && os.Getenv("SSH_AUTH_SOCK") == "" {
+			cleanup()
+			fmt.Println("=> Oh no, the build forwards the SSH agent, but SSH_AUTH_SOCK isn't set. Is ssh-agent running?")
+			exitWithMetadata(repoConfig)
+		}
+		args += fmt.Sprintf("--ssh %s ", ssh)
+	}
+	return args, cleanup
+}
@@ -7,50 +7,89 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 )
 
+// streamLock keeps lines from commands streaming at the same time (eg. parallel test sets) from interleaving
+var streamLock sync.Mutex
+
 func GetCommandOutput(cmdName string, cmdArgs string) string {
-	output, _ := runCommand(cmdName, cmdArgs, false, false)
+	output, _ := runCommand(cmdName, cmdArgs, "", false, false)
 	return output
 }
 
 func GetCommandExitCode(cmdName string, cmdArgs string) int {
-	_, exit := runCommand(cmdName, cmdArgs, false, true) // Sends quiet signal
+	_, exit := runCommand(cmdName, cmdArgs, "", false, true) // Sends quiet signal
 	return exit
 }
 
+// GetQuietCommandOutputAndExitCode doesn't complain if the command fails, for commands where failing is an answer
+func GetQuietCommandOutputAndExitCode(cmdName string, cmdArgs string) (string, int) {
+	output, exit := runCommand(cmdName, cmdArgs, "", false, true)
+	return output, exit
+}
+
 func GetCommandOutputAndExitCode(cmdName string, cmdArgs string) (string, int) {
-	output, exit := runCommand(cmdName, cmdArgs, false, false)
+	output, exit := runCommand(cmdName, cmdArgs, "", false, false)
 	return output, exit
 }
 
 func StreamAndGetCommandOutput(cmdName string, cmdArgs string) string {
-	output, _ := runCommand(cmdName, cmdArgs, true, false)
+	output, _ := runCommand(cmdName, cmdArgs, "", true, false)
 	return output
 }
 func StreamAndGetCommandOutputAndExitCode(cmdName string, cmdArgs string) (string, int) {
-	output, exit := runCommand(cmdName, cmdArgs, true, false)
+	output, exit := runCommand(cmdName, cmdArgs, "", true, false)
 	return output, exit
 }
 
 func StreamAndGetCommandExitCode(cmdName string, cmdArgs string) int {
-	_, exit := runCommand(cmdName, cmdArgs, true, false)
+	_, exit := runCommand(cmdName, cmdArgs, "", true, false)
 	return exit
 }
 
+// GetCommandStdoutAndExitCode only returns what the command wrote to stdout (eg. a JSON report), leaving out any logging on stderr
+func GetCommandStdoutAndExitCode(cmdName string, cmdArgs string) (string, int) {
+	stdout, _, exit := runCommandOutputs(cmdName, cmdArgs, "", false, false)
+	return stdout, exit
+}
+
+// The 'WithPrefix' variants label every streamed line, so that the output of commands running side by side can be told apart
+func StreamAndGetCommandOutputAndExitCodeWithPrefix(prefix string, cmdName string, cmdArgs string) (string, int) {
+	output, exit := runCommand(cmdName, cmdArgs, prefix, true, false)
+	return output, exit
+}
+
+func StreamAndGetCommandExitCodeWithPrefix(prefix string, cmdName string, cmdArgs string) int {
+	_, exit := runCommand(cmdName, cmdArgs, prefix, true, false)
+	return exit
+}
+
+// Printf prints a message with the given prefix, without interleaving with any lines being streamed from commands
+func Printf(prefix string, format string, a ...interface{}) {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	for _, l := range strings.Split(strings.TrimSuffix(fmt.Sprintf(format, a...), "\n"), "\n") {
+		fmt.Println(prefix + l)
+	}
+}
+
 type output struct {
 	buf         *bytes.Buffer
 	stream      bool
+	prefix      string
 	combinedOut *combinedOutput
 }
 
 func (o *output) Write(p []byte) (int, error) {
 	if o.stream {
 		splitByNewline := strings.Split(strings.Trim(string(p), "\n"), "\n")
+		streamLock.Lock()
 		for _, l := range splitByNewline {
-			fmt.Println("\t| ", l)
+			fmt.Println(o.prefix+"\t| ", l)
 		}
+		streamLock.Unlock()
 	}
 	o.combinedOut.Write(string(p))
 	return o.buf.Write(p)
@@ -64,7 +103,12 @@ func (c *combinedOutput) Write(s string) {
 	c.lines = append(c.lines, s)
 }
 
-func runCommand(cmdName string, cmdArgs string, stream bool, quiet bool) (string, int) {
+func runCommand(cmdName string, cmdArgs string, prefix string, stream bool, quiet bool) (string, int) {
+	_, combined, exit := runCommandOutputs(cmdName, cmdArgs, prefix, stream, quiet)
+	return combined, exit
+}
+
+func runCommandOutputs(cmdName string, cmdArgs string, prefix string, stream bool, quiet bool) (string, string, int) {
 
 	// This cmdArgs mess is to facilitate running arbitrary shell commands via `bash -c "<command>"`
 	// Regex will split into groups either by whitespace or by quotation marks
@@ -85,6 +129,7 @@ func runCommand(cmdName string, cmdArgs string, stream bool, quiet bool) (string
 	var sout = &output{
 		buf:         &bytes.Buffer{},
 		stream:      stream,
+		prefix:      prefix,
 		combinedOut: combinedOutput,
 	}
 	cmd.Stdout = sout
@@ -92,6 +137,7 @@ func runCommand(cmdName string, cmdArgs string, stream bool, quiet bool) (string
 	var serr = &output{
 		buf:         &bytes.Buffer{},
 		stream:      stream,
+		prefix:      prefix,
 		combinedOut: combinedOutput,
 	}
 	cmd.Stderr = serr
@@ -135,5 +181,5 @@ func runCommand(cmdName string, cmdArgs string, stream bool, quiet bool) (string
 		}
 	}
 
-	return strings.Join(combinedOutput.lines, "\n"), exitCode
+	return sout.buf.String(), strings.Join(combinedOutput.lines, "\n"), exitCode
 }
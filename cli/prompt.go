@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+var (
+	promptReader   = bufio.NewReader(os.Stdin)
+	assumeYes      bool
+	nonInteractive bool
+	promptDefaults map[string]bool
+)
+
+// SetupPrompts decides how prompts get answered: '--yes' answers all of them with 'y', and in non-interactive mode
+// (or without a terminal on stdin) they get the default answer from the deploy.yaml 'prompts' section
+func SetupPrompts(yes bool, nonInteractiveFlag bool, defaults map[string]bool) {
+	assumeYes = yes
+	nonInteractive = nonInteractiveFlag || !stdinIsTerminal()
+	promptDefaults = defaults
+}
+
+// Interactive is true if prompts are actually answered by a person
+func Interactive() bool {
+	return !assumeYes && !nonInteractive
+}
+
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// CheckPromptsAnswerable returns an error if running non-interactively (without '--yes'), and any of the prompts has no
+// default answer - so that a run which would get to one of them can stop before it changes anything
+func CheckPromptsAnswerable(promptIDs ...string) error {
+	if assumeYes || !nonInteractive {
+		return nil
+	}
+	for _, promptID := range promptIDs {
+		if _, ok := promptDefaults[promptID]; !ok {
+			return noDefaultError(promptID)
+		}
+	}
+	return nil
+}
+
+func noDefaultError(promptID string) error {
+	return fmt.Errorf("I'm running non-interactively, but there's no default answer for the prompt '%s'. Add 'prompts: { %s: true }' (or false) to the deploy.yaml, or use '--yes' to answer 'y' to everything.", promptID, promptID)
+}
+
+// AskToProceed asks a yes/no question, identified by the promptID so that a default answer can be configured for it.
+// A question which can't be answered is taken as a 'n', so that the caller can stop safely (eg. bail out of a rollout).
+func AskToProceed(promptID string, promptMessage string) bool {
+	proceed, err := Ask(promptID, promptMessage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "=> Oh no! %s\n=> So I'm taking that as a 'n'.\n", err)
+	}
+	return proceed
+}
+
+// Ask is AskToProceed for callers which need to tell a 'n' apart from a question which couldn't be answered
+// (running non-interactively without a default answer, or stdin couldn't be read)
+func Ask(promptID string, promptMessage string) (bool, error) {
+	fmt.Printf("=> %s\n", promptMessage)
+
+	if assumeYes {
+		fmt.Printf("=> Answering 'y' to '%s', because of '--yes'.\n", promptID)
+		return true, nil
+	}
+	if nonInteractive {
+		answer, ok := promptDefaults[promptID]
+		if !ok {
+			return false, noDefaultError(promptID)
+		}
+		fmt.Printf("=> Answering '%s' to '%s', the configured default.\n", yesOrNo(answer), promptID)
+		return answer, nil
+	}
+
+	fmt.Print("=> Press 'y' to proceed, anything else to exit.\n>>> ")
+	answer, err := promptReader.ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("I couldn't read an answer to the prompt '%s': %s.", promptID, err)
+	}
+	return answer == "y\n" || answer == "Y\n", nil
+}
+
+func yesOrNo(answer bool) string {
+	if answer {
+		return "y"
+	}
+	return "n"
+}
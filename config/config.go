@@ -2,11 +2,14 @@ package config
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"text/template"
 
@@ -40,33 +43,186 @@ type Application struct {
 	KubernetesTemplate    KubernetesTemplate `yaml:"kubernetesTemplate"`
 }
 
+// Build : options for how the docker image is built
+type Build struct {
+	Backend   string        `yaml:"backend"` // 'docker' (default) or 'kaniko'
+	Kaniko    BuildKaniko   `yaml:"kaniko"`
+	Cache     BuildCache    `yaml:"cache"`
+	Scan      BuildScan     `yaml:"scan"`
+	GitChecks GitChecks     `yaml:"gitChecks"`
+	Secrets   []BuildSecret `yaml:"secrets"` // values mounted as BuildKit secrets, instead of build arguments
+	SSH       []string      `yaml:"ssh"`     // SSH agents or keys forwarded to the build, eg. 'default'
+}
+
+// BuildSecret : a value the Dockerfile can read from '/run/secrets/<id>' during a RUN step, without it ending up in the image
+type BuildSecret struct {
+	ID       string `yaml:"id"`
+	Variable string `yaml:"variable"` // the branch variable holding the value (defaults to the ID)
+	File     string `yaml:"file"`     // a file holding the value, instead of a branch variable
+}
+
+// GitChecks : the checks on the git repository which have to pass before building
+// (by default only for branches deploying to the production cluster)
+type GitChecks struct {
+	AllBranches       bool  `yaml:"allBranches"`       // run the checks for every branch
+	NoUntrackedFiles  *bool `yaml:"noUntrackedFiles"`  // there can't be untracked files, which would end up in the build context (default true)
+	Pushed            bool  `yaml:"pushed"`            // HEAD has to be on a remote branch
+	NotBehindUpstream bool  `yaml:"notBehindUpstream"` // the branch can't be missing commits from its upstream branch
+	SignedCommits     bool  `yaml:"signedCommits"`     // HEAD has to have a good GPG signature
+	Tagged            bool  `yaml:"tagged"`            // HEAD has to match a tag
+}
+
+// BuildKaniko : where and how the image is built in the cluster, for the 'kaniko' backend
+type BuildKaniko struct {
+	Namespace          string `yaml:"namespace"`          // namespace the build job runs in (default 'kube-deploy')
+	Image              string `yaml:"image"`              // the Kaniko executor image
+	ContextBucket      string `yaml:"contextBucket"`      // 'gs://bucket/path' or 's3://bucket/path' - the build context is uploaded here
+	ServiceAccount     string `yaml:"serviceAccount"`     // service account of the build pod, eg. with access to the bucket and registry
+	DockerConfigSecret string `yaml:"dockerConfigSecret"` // secret of type 'kubernetes.io/dockerconfigjson' with the registry login
+	CacheRepo          string `yaml:"cacheRepo"`          // repository for Kaniko's layer cache (no caching if empty)
+	TimeoutSeconds     int64  `yaml:"timeoutSeconds"`     // how long the build job can take (default 1800)
+}
+
+// BuildCache : which images are used as the docker build cache, and how the cache is exported
+type BuildCache struct {
+	Mode             string   `yaml:"mode"`             // 'docker' (default), 'inline' or 'registry'
+	FallbackBranches []string `yaml:"fallbackBranches"` // branches whose cache is tried after the current branch's cache
+}
+
+// BuildScan : the vulnerability scanner which has to pass before an image is pushed
+type BuildScan struct {
+	Command           string `yaml:"command"`           // eg. 'trivy image --format json --quiet' - the image name is appended
+	Format            string `yaml:"format"`            // 'trivy' or 'grype' (guessed from the command if empty)
+	SeverityThreshold string `yaml:"severityThreshold"` // findings at or above this severity block the push (default 'HIGH')
+	AllowlistFile     string `yaml:"allowlistFile"`     // file listing accepted vulnerability IDs, one per line
+	Required          bool   `yaml:"required"`          // the scan can't be skipped (always the case for the production cluster)
+}
+
+// Rollout : how a rollout goes through its canary points
+type Rollout struct {
+	Strategy       string           `yaml:"strategy"` // for Deployments: 'canary' (default) or 'blue-green'
+	Analysis       RolloutAnalysis  `yaml:"analysis"`
+	Steps          []RolloutStep    `yaml:"steps"` // the plan for rolling out a Deployment (the classic plan if empty)
+	Traffic        RolloutTraffic   `yaml:"traffic"`
+	BlueGreen      RolloutBlueGreen `yaml:"blueGreen"`
+	Hooks          []RolloutHook    `yaml:"hooks"`
+	HookRunsToKeep int              `yaml:"hookRunsToKeep"` // how many finished runs of each hook Job are left in the cluster (default 3)
+	KeepReleases   int              `yaml:"keepReleases"`   // how many older releases scaled down to 0 are kept, to roll back to (default 1)
+}
+
+// RolloutHook : a Job from the Kubernetes files which runs once per rollout (eg. a database migration), instead of
+// being applied with the other objects
+type RolloutHook struct {
+	Job   string `yaml:"job"`   // the name of the Job, as it is after templating
+	Phase string `yaml:"phase"` // 'pre-rollout' (before anything is applied) or 'post-rollout' (after the rollout succeeded)
+}
+
+// RolloutBlueGreen : the 'blue-green' strategy brings the new release up to full size without any traffic, and
+// then switches the Service over to it in one step. The previous release keeps its pods, to switch back to.
+type RolloutBlueGreen struct {
+	Service        string `yaml:"service"`        // the Service which is switched from the previous release to the new one
+	PreviewService string `yaml:"previewService"` // the Service to try the new release through before the switch (default '<service>-preview')
+	PreviewSeconds int    `yaml:"previewSeconds"` // the canary point before the switch (default 300)
+	SwitchSeconds  int    `yaml:"switchSeconds"`  // the canary point after the switch, before the rollout is done (default 300)
+}
+
+// IsBlueGreen is true for the 'blue-green' strategy
+func (r Rollout) IsBlueGreen() bool {
+	return r.Strategy == "blue-green"
+}
+
+// RolloutTraffic : how the traffic is split between the previous release and the new one. Without a router,
+// the traffic follows the number of pods of each release behind the Service.
+type RolloutTraffic struct {
+	Router            string `yaml:"router"`            // 'nginx' or 'istio'
+	Service           string `yaml:"service"`           // the Service in front of the pods of the releases
+	Ingress           string `yaml:"ingress"`           // for 'nginx': the Ingress which the canary Ingress is copied from
+	VirtualService    string `yaml:"virtualService"`    // for 'istio': the VirtualService routing to the Service
+	CanaryHeader      string `yaml:"canaryHeader"`      // requests with this header go to the new release (default 'X-Canary')
+	CanaryHeaderValue string `yaml:"canaryHeaderValue"` // ...if it has this value (default 'always')
+}
+
+// RolloutStep : one step of a rollout plan, which scales the new release (and/or scales the previous release down),
+// and then holds at a canary point
+type RolloutStep struct {
+	Replicas          *int32 `yaml:"replicas"`          // scale the new release to this many pods
+	Percent           *int   `yaml:"percent"`           // or to this percentage of the previous release's pods (rounded up)
+	ScaleDownPrevious bool   `yaml:"scaleDownPrevious"` // scale the previous release down to 0 pods
+	PauseSeconds      int    `yaml:"pauseSeconds"`      // the minimum time to hold at the canary point
+	Analysis          bool   `yaml:"analysis"`          // check the 'rollout.analysis' queries during the pause
+	Approval          bool   `yaml:"approval"`          // ask someone whether to go on (after the pause)
+	Weight            *int   `yaml:"weight"`            // the percentage of the traffic the new release gets (needs a traffic router)
+	HeaderOnly        bool   `yaml:"headerOnly"`        // only requests with the canary header go to the new release
+}
+
+// RolloutAnalysis : metrics which decide whether a canary point passes, instead of asking someone
+type RolloutAnalysis struct {
+	PrometheusURL   string          `yaml:"prometheusURL"`   // base URL of a Prometheus-compatible query API
+	IntervalSeconds int             `yaml:"intervalSeconds"` // how often the queries run during a canary point (default 30)
+	Queries         []AnalysisQuery `yaml:"queries"`
+}
+
+// Enabled : whether the canary points are analysed, instead of asking someone
+func (a RolloutAnalysis) Enabled() bool {
+	return len(a.Queries) > 0
+}
+
+// AnalysisQuery : a query which has to return a single number, templated with {{.Release}}, {{.PreviousRelease}},
+// {{.App}} and {{.Namespace}}. The absolute thresholds apply to the value for the release, and the relative ones
+// compare it with the value of the same query for the previous release.
+type AnalysisQuery struct {
+	Name        string   `yaml:"name"`
+	Query       string   `yaml:"query"`
+	Max         *float64 `yaml:"max"`
+	Min         *float64 `yaml:"min"`
+	MaxIncrease *float64 `yaml:"maxIncrease"` // eg. 0.2 fails the canary if its value is more than 20% above the previous release's
+	MaxDecrease *float64 `yaml:"maxDecrease"` // eg. 0.2 fails the canary if its value is more than 20% below the previous release's
+}
+
 // RepoConfigMap : hash of the YAML data from project's deploy.yaml
 type RepoConfigMap struct {
 	DockerRepository     DockerRepository `yaml:"dockerRepository"`
 	Application          Application      `yaml:"application"`
+	Build                Build            `yaml:"build"`
+	Rollout              Rollout          `yaml:"rollout"`
 	DockerRepositoryName string
 	ClusterName          string // 'production' or 'development' - 'staging' should use the production cluster
 	Namespace            string
 	GitBranch            string
 	GitSHA               string
+	GitTreeHash          string
+	GitCommitSubject     string
+	CIBuildURL           string // the page of the CI build running kube-deploy, if there is one
+	DeployConfigHash     string // the SHA-256 of the deploy.yaml
 	ImageName            string
+	DevelopmentImageName string // the image name in the development repository, which images are promoted from
+	ProductionImageName  string // the image name in the production repository, which images are promoted to
 	ImageTag             string
-	ImageCachePath       string
+	ImageCachePath       string   // the cache shared by all branches for this version
+	ImageBranchCachePath string   // the cache pushed by this branch
+	ImageCacheFromPaths  []string // all caches to try, in order of preference
+	ImageContentTag      string   // tag based on the content of the build (empty if the working directory is dirty)
+	ImageContentPath     string
 	ImageFullPath        string `yaml:"imageFullPath"`
+	ImageDigest          string // the digest of the pushed image, once it's known
+	ImageRef             string // the image name pinned to the digest (name@sha256:...), once it's known
 	PWD                  string
 	EnvVarsMap           envMapping
 	ReleaseName          string
 	KubeAPIClientSet     *kubernetes.Clientset
-	Tests                []testConfigMap `yaml:"tests"`
+	Tests                []TestConfigMap `yaml:"tests"`
+	Prompts              map[string]bool `yaml:"prompts"` // default answers to prompts when running non-interactively, by prompt ID
 }
 
-// testConfigMap : layout of the details for running a single test step (during build)
-type testConfigMap struct {
+// TestConfigMap : layout of the details for running a single test step (during build)
+type TestConfigMap struct {
 	Name          string   `yaml:"name"`
 	DockerArgs    string   `yaml:"dockerArgs"`
 	DockerCommand string   `yaml:"dockerCommand"`
 	Type          string   `yaml:"type"`
 	Commands      []string `yaml:"commands"`
+	Parallel      bool     `yaml:"parallel"`  // run alongside the other test sets, instead of after all of them
+	DependsOn     []string `yaml:"dependsOn"` // names of earlier test sets that have to pass before this one starts
 }
 
 func InitRepoConfig(configFilePath string) RepoConfigMap {
@@ -88,6 +244,10 @@ func InitRepoConfig(configFilePath string) RepoConfigMap {
 	invalidDockertagCharRegex := regexp.MustCompile(`([^a-z|A-Z|0-9|\-|_|\.])`)
 	repoConfig.GitBranch = invalidDockertagCharRegex.ReplaceAllString(repoConfig.GitBranch, "-")
 	repoConfig.GitSHA = strings.TrimSuffix(cli.GetCommandOutput("git", "rev-parse --verify --short HEAD"), "\n")
+	repoConfig.GitTreeHash = strings.TrimSuffix(cli.GetCommandOutput("git", "rev-parse --verify HEAD^{tree}"), "\n")
+	repoConfig.GitCommitSubject = strings.TrimSuffix(cli.GetCommandOutput("git", "log -1 --format=%s"), "\n")
+	repoConfig.CIBuildURL = ciBuildURL()
+	repoConfig.DeployConfigHash = fmt.Sprintf("%x", sha256.Sum256(configFile))
 
 	if repoConfig.Application.PackageJSON {
 		repoConfig.Application.Name, repoConfig.Application.Version = readFromPackageJSON()
@@ -97,45 +257,36 @@ func InitRepoConfig(configFilePath string) RepoConfigMap {
 		repoConfig.GitBranch = "production"
 	}
 
+	repoConfig.DockerRepositoryName = repositoryNameForBranch(repoConfig.DockerRepository, repoConfig.GitBranch)
+
 	switch branch := repoConfig.GitBranch; branch {
 	case "production":
-		repoConfig.DockerRepositoryName = repoConfig.DockerRepository.ProductionRepositoryName
 		repoConfig.ClusterName = "production"
 		if repoConfig.Namespace == "" {
 			repoConfig.Namespace = "production"
 		}
 	case "master":
-		repoConfig.DockerRepositoryName = repoConfig.DockerRepository.ProductionRepositoryName
 		repoConfig.ClusterName = "production" // deploy to production cluster
 		if repoConfig.Namespace == "" {
 			repoConfig.Namespace = "staging"
 		}
 	case "acceptance":
-		repoConfig.DockerRepositoryName = repoConfig.DockerRepository.ProductionRepositoryName
 		repoConfig.ClusterName = "production"
 		if repoConfig.Namespace == "" {
 			repoConfig.Namespace = "acceptance"
 		}
 	case "preview", "preview-lannister", "preview-stark", "preview-baratheon", "preview-targaryen", "preview-arryn", "preview-bolton", "preview-greyjoy", "preview-frey":
-		repoConfig.DockerRepositoryName = repoConfig.DockerRepository.ProductionRepositoryName
 		repoConfig.ClusterName = "production"
 		if repoConfig.Namespace == "" {
 			repoConfig.Namespace = "preview"
 		}
 	default:
-		repoConfig.DockerRepositoryName = repoConfig.DockerRepository.DevelopmentRepositoryName
 		repoConfig.ClusterName = "development"
 		if repoConfig.Namespace == "" {
 			repoConfig.Namespace = "development"
 		}
 	}
 
-	for heading := range repoConfig.DockerRepository.BranchRepositoryName {
-		if repoConfig.GitBranch == heading {
-			repoConfig.DockerRepositoryName = repoConfig.DockerRepository.BranchRepositoryName[heading]
-		}
-	}
-
 	repoConfig.ImageTag = fmt.Sprintf("%s-%s-%s",
 		repoConfig.Application.Version,
 		fmt.Sprintf("%.25s", repoConfig.GitBranch),
@@ -145,16 +296,183 @@ func InitRepoConfig(configFilePath string) RepoConfigMap {
 		repoConfig.Application.Version)
 
 	if repoConfig.ImageFullPath == "" { // if the path was not already provided in the deploy.yaml
-		if repoConfig.DockerRepository.RegistryRoot != "" {
-			repoConfig.ImageName = fmt.Sprintf("%s/%s/%s", repoConfig.DockerRepository.RegistryRoot, repoConfig.DockerRepositoryName, repoConfig.Application.Name)
-		} else { // For DockerHub images, no RegistryRoot is needed
-			repoConfig.ImageName = fmt.Sprintf("%s/%s", repoConfig.DockerRepositoryName, repoConfig.Application.Name)
-		}
+		repoConfig.ImageName = imageNameForRepository(repoConfig.DockerRepository, repoConfig.DockerRepositoryName, repoConfig.Application.Name)
 	}
 
+	repoConfig.DevelopmentImageName = imageNameForRepository(repoConfig.DockerRepository, repoConfig.DockerRepository.DevelopmentRepositoryName, repoConfig.Application.Name)
+	repoConfig.ProductionImageName = imageNameForRepository(repoConfig.DockerRepository, repoConfig.DockerRepository.ProductionRepositoryName, repoConfig.Application.Name)
+
 	repoConfig.ImageFullPath = fmt.Sprintf("%s:%s", repoConfig.ImageName, repoConfig.ImageTag)
 	repoConfig.ImageCachePath = fmt.Sprintf("%s:%s", repoConfig.ImageName, cacheTag)
 
+	switch repoConfig.Build.Backend {
+	case "", "docker":
+	case "kaniko":
+		if len(repoConfig.Build.Secrets) > 0 || len(repoConfig.Build.SSH) > 0 {
+			fmt.Fprintln(os.Stderr, "=> Sorry, build secrets and SSH forwarding need BuildKit, so they don't work with the Kaniko backend.")
+			os.Exit(1)
+		}
+		if !strings.HasPrefix(repoConfig.Build.Kaniko.ContextBucket, "gs://") && !strings.HasPrefix(repoConfig.Build.Kaniko.ContextBucket, "s3://") {
+			fmt.Fprintln(os.Stderr, "=> Building with Kaniko needs a 'build.kaniko.contextBucket' starting with 'gs://' or 's3://'.")
+			os.Exit(1)
+		}
+		if repoConfig.Build.Kaniko.Namespace == "" {
+			repoConfig.Build.Kaniko.Namespace = "kube-deploy"
+		}
+		if repoConfig.Build.Kaniko.Image == "" {
+			repoConfig.Build.Kaniko.Image = "gcr.io/kaniko-project/executor:v1.3.0"
+		}
+		if repoConfig.Build.Kaniko.TimeoutSeconds == 0 {
+			repoConfig.Build.Kaniko.TimeoutSeconds = 1800
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "=> Unknown build backend '%s' - use 'docker' or 'kaniko'.\n", repoConfig.Build.Backend)
+		os.Exit(1)
+	}
+
+	for i, secret := range repoConfig.Build.Secrets {
+		if secret.ID == "" {
+			fmt.Fprintln(os.Stderr, "=> Every build secret needs an 'id'.")
+			os.Exit(1)
+		}
+		if secret.Variable == "" {
+			repoConfig.Build.Secrets[i].Variable = secret.ID
+		}
+	}
+
+	if analysis := repoConfig.Rollout.Analysis; analysis.Enabled() {
+		if analysis.PrometheusURL == "" {
+			fmt.Fprintln(os.Stderr, "=> The canary analysis needs a 'rollout.analysis.prometheusURL'.")
+			os.Exit(1)
+		}
+		for _, query := range analysis.Queries {
+			if query.Name == "" || query.Query == "" {
+				fmt.Fprintln(os.Stderr, "=> Every canary analysis query needs a 'name' and a 'query'.")
+				os.Exit(1)
+			}
+			if query.Max == nil && query.Min == nil && query.MaxIncrease == nil && query.MaxDecrease == nil {
+				fmt.Fprintf(os.Stderr, "=> The canary analysis query '%s' needs at least one of 'max', 'min', 'maxIncrease' or 'maxDecrease'.\n", query.Name)
+				os.Exit(1)
+			}
+		}
+		if analysis.IntervalSeconds <= 0 {
+			repoConfig.Rollout.Analysis.IntervalSeconds = 30
+		}
+	}
+
+	switch traffic := repoConfig.Rollout.Traffic; traffic.Router {
+	case "":
+	case "nginx", "istio":
+		if traffic.Service == "" {
+			fmt.Fprintln(os.Stderr, "=> The traffic router needs the 'rollout.traffic.service' to split the traffic of.")
+			os.Exit(1)
+		}
+		if traffic.Router == "nginx" && traffic.Ingress == "" || traffic.Router == "istio" && traffic.VirtualService == "" {
+			fmt.Fprintf(os.Stderr, "=> The '%s' traffic router needs the 'rollout.traffic.%s' which routes to the Service.\n",
+				traffic.Router, map[string]string{"nginx": "ingress", "istio": "virtualService"}[traffic.Router])
+			os.Exit(1)
+		}
+		if traffic.CanaryHeader == "" {
+			repoConfig.Rollout.Traffic.CanaryHeader = "X-Canary"
+		}
+		if traffic.CanaryHeaderValue == "" {
+			repoConfig.Rollout.Traffic.CanaryHeaderValue = "always"
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "=> Unknown traffic router '%s' - use 'nginx' or 'istio'.\n", traffic.Router)
+		os.Exit(1)
+	}
+
+	switch repoConfig.Rollout.Strategy {
+	case "", "canary":
+	case "blue-green":
+		blueGreen := repoConfig.Rollout.BlueGreen
+		if blueGreen.Service == "" {
+			fmt.Fprintln(os.Stderr, "=> The blue-green strategy needs the 'rollout.blueGreen.service' to switch over to the new release.")
+			os.Exit(1)
+		}
+		if len(repoConfig.Rollout.Steps) > 0 || repoConfig.Rollout.Traffic.Router != "" {
+			fmt.Fprintln(os.Stderr, "=> The blue-green strategy switches all of the traffic at once, so it can't have 'rollout.steps' or a 'rollout.traffic.router'.")
+			os.Exit(1)
+		}
+		if blueGreen.PreviewService == "" {
+			repoConfig.Rollout.BlueGreen.PreviewService = blueGreen.Service + "-preview"
+		}
+		if blueGreen.PreviewSeconds <= 0 {
+			repoConfig.Rollout.BlueGreen.PreviewSeconds = 300
+		}
+		if blueGreen.SwitchSeconds <= 0 {
+			repoConfig.Rollout.BlueGreen.SwitchSeconds = 300
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "=> Unknown rollout strategy '%s' - use 'canary' or 'blue-green'.\n", repoConfig.Rollout.Strategy)
+		os.Exit(1)
+	}
+
+	hookJobs := map[string]bool{}
+	for _, hook := range repoConfig.Rollout.Hooks {
+		switch {
+		case hook.Job == "":
+			fmt.Fprintln(os.Stderr, "=> Every rollout hook needs the name of its 'job'.")
+			os.Exit(1)
+		case hook.Phase != "pre-rollout" && hook.Phase != "post-rollout":
+			fmt.Fprintf(os.Stderr, "=> The rollout hook %s needs a 'phase' of 'pre-rollout' or 'post-rollout'.\n", hook.Job)
+			os.Exit(1)
+		case hookJobs[hook.Job]:
+			fmt.Fprintf(os.Stderr, "=> The job %s can only be one rollout hook.\n", hook.Job)
+			os.Exit(1)
+		}
+		hookJobs[hook.Job] = true
+	}
+	if repoConfig.Rollout.HookRunsToKeep <= 0 {
+		repoConfig.Rollout.HookRunsToKeep = 3
+	}
+	// The release before the live one always stays, for an instant rollback
+	if repoConfig.Rollout.KeepReleases <= 0 {
+		repoConfig.Rollout.KeepReleases = 1
+	}
+
+	for i, step := range repoConfig.Rollout.Steps {
+		switch {
+		case (step.Weight != nil || step.HeaderOnly) && repoConfig.Rollout.Traffic.Router == "":
+			fmt.Fprintf(os.Stderr, "=> Rollout step %d routes traffic, but there's no 'rollout.traffic.router'.\n", i+1)
+			os.Exit(1)
+		case step.Weight != nil && (*step.Weight < 0 || *step.Weight > 100):
+			fmt.Fprintf(os.Stderr, "=> The 'weight' of rollout step %d has to be from 0 to 100.\n", i+1)
+			os.Exit(1)
+		case step.Replicas != nil && step.Percent != nil:
+			fmt.Fprintf(os.Stderr, "=> Rollout step %d can have 'replicas' or 'percent', but not both.\n", i+1)
+			os.Exit(1)
+		case step.Percent != nil && *step.Percent <= 0:
+			fmt.Fprintf(os.Stderr, "=> The 'percent' of rollout step %d has to be more than 0.\n", i+1)
+			os.Exit(1)
+		case step.Analysis && !repoConfig.Rollout.Analysis.Enabled():
+			fmt.Fprintf(os.Stderr, "=> Rollout step %d uses the canary analysis, but 'rollout.analysis' has no queries.\n", i+1)
+			os.Exit(1)
+		case step.Analysis && step.PauseSeconds <= 0:
+			fmt.Fprintf(os.Stderr, "=> Rollout step %d needs 'pauseSeconds', to know how long to run the canary analysis for.\n", i+1)
+			os.Exit(1)
+		}
+	}
+
+	// Try the branch's own cache first, then the caches of the fallback branches, then the cache for the version
+	switch repoConfig.Build.Cache.Mode {
+	case "", "docker", "inline", "registry":
+	default:
+		fmt.Fprintf(os.Stderr, "=> Unknown build cache mode '%s' - use one of 'docker', 'inline' or 'registry'.\n", repoConfig.Build.Cache.Mode)
+		os.Exit(1)
+	}
+	if len(repoConfig.Build.Cache.FallbackBranches) == 0 {
+		repoConfig.Build.Cache.FallbackBranches = []string{"master", "production"}
+	}
+	repoConfig.ImageBranchCachePath = branchCachePath(repoConfig.ImageName, repoConfig.Application.Version, repoConfig.GitBranch)
+	repoConfig.ImageCacheFromPaths = []string{repoConfig.ImageBranchCachePath}
+	for _, branch := range repoConfig.Build.Cache.FallbackBranches {
+		fallbackImageName := imageNameForRepository(repoConfig.DockerRepository, repositoryNameForBranch(repoConfig.DockerRepository, branch), repoConfig.Application.Name)
+		repoConfig.ImageCacheFromPaths = appendIfMissing(repoConfig.ImageCacheFromPaths, branchCachePath(fallbackImageName, repoConfig.Application.Version, branch))
+	}
+	repoConfig.ImageCacheFromPaths = appendIfMissing(repoConfig.ImageCacheFromPaths, repoConfig.ImageCachePath)
+
 	repoConfig.ReleaseName = fmt.Sprintf("%.25s-%s", repoConfig.Application.Name, repoConfig.ImageTag)
 	repoConfig.PWD, err = os.Getwd()
 
@@ -162,12 +480,93 @@ func InitRepoConfig(configFilePath string) RepoConfigMap {
 	envConfig := newEnvMappingFromRepoConfig(repoConfig)
 
 	repoConfig.Namespace = envConfig.GetNameSpace()
+
+	// The content tag lets any branch reuse an image built from exactly the same tree
+	if cli.GetCommandOutput("git", "status --porcelain") == "" {
+		repoConfig.ImageContentTag = fmt.Sprintf("tree-%.12s-%.12s", repoConfig.GitTreeHash, buildContextDigest(repoConfig, envConfig))
+		repoConfig.ImageContentPath = fmt.Sprintf("%s:%s", repoConfig.ImageName, repoConfig.ImageContentTag)
+	}
+
 	repoConfig.KubeAPIClientSet = kubeapi.Setup(envConfig.GetNameSpace())
 	repoConfig.EnvVarsMap = envConfig
 
 	return repoConfig
 }
 
+// repositoryNameForBranch returns the docker repository that images built from the given branch are pushed to
+func repositoryNameForBranch(dockerRepository DockerRepository, branch string) string {
+	if repositoryName, ok := dockerRepository.BranchRepositoryName[branch]; ok {
+		return repositoryName
+	}
+	switch branch {
+	case "production", "master", "acceptance", "preview", "preview-lannister", "preview-stark", "preview-baratheon", "preview-targaryen", "preview-arryn", "preview-bolton", "preview-greyjoy", "preview-frey":
+		return dockerRepository.ProductionRepositoryName
+	default:
+		return dockerRepository.DevelopmentRepositoryName
+	}
+}
+
+func imageNameForRepository(dockerRepository DockerRepository, repositoryName string, applicationName string) string {
+	if dockerRepository.RegistryRoot != "" {
+		return fmt.Sprintf("%s/%s/%s", dockerRepository.RegistryRoot, repositoryName, applicationName)
+	}
+	// For DockerHub images, no RegistryRoot is needed
+	return fmt.Sprintf("%s/%s", repositoryName, applicationName)
+}
+
+func branchCachePath(imageName string, version string, branch string) string {
+	return fmt.Sprintf("%s:%s-%.25s-cache", imageName, version, branch)
+}
+
+func appendIfMissing(list []string, item string) []string {
+	for _, existing := range list {
+		if existing == item {
+			return list
+		}
+	}
+	return append(list, item)
+}
+
+// buildContextDigest hashes everything outside of the git tree which changes what the docker build produces
+func buildContextDigest(r RepoConfigMap, envConfig envMapping) string {
+	digest := sha256.New()
+	for _, filename := range []string{"Dockerfile", ".dockerignore"} {
+		fileContents, _ := ioutil.ReadFile(filepath.Join(r.PWD, filename))
+		fmt.Fprintf(digest, "%s:%x\n", filename, sha256.Sum256(fileContents))
+	}
+	if r.Application.ExposeBuildArgs {
+		// Build arguments include branch-specific values, so images built with them are effectively never reused
+		keys := make([]string, 0, len(envConfig))
+		for key := range envConfig {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !r.Build.IsSecretVariable(key) {
+				fmt.Fprintf(digest, "--build-arg %s=%s\n", key, envConfig[key])
+			}
+		}
+	}
+	// Only the names of the secrets - their values shouldn't be derivable from a tag
+	for _, secret := range r.Build.Secrets {
+		fmt.Fprintf(digest, "--secret id=%s\n", secret.ID)
+	}
+	for _, ssh := range r.Build.SSH {
+		fmt.Fprintf(digest, "--ssh %s\n", ssh)
+	}
+	return fmt.Sprintf("%x", digest.Sum(nil))
+}
+
+// IsSecretVariable is true if the branch variable is mounted as a build secret, so it must never become a build argument
+func (b Build) IsSecretVariable(variable string) bool {
+	for _, secret := range b.Secrets {
+		if secret.File == "" && secret.Variable == variable {
+			return true
+		}
+	}
+	return false
+}
+
 func readFromPackageJSON() (string, string) {
 
 	type packageJSONTemplate struct {
@@ -236,6 +635,9 @@ func newEnvMappingFromRepoConfig(r RepoConfigMap) envMapping {
 	envConfig["KD_GIT_SHA"] = r.GitSHA
 	envConfig["KD_IMAGE_FULL_PATH"] = r.ImageFullPath
 	envConfig["KD_IMAGE_TAG"] = r.ImageTag
+	// These are replaced with the digest once the image is pushed (or found on the remote)
+	envConfig["KD_IMAGE_DIGEST"] = ""
+	envConfig["KD_IMAGE_REF"] = r.ImageFullPath
 
 	funcMap := template.FuncMap{
 		// The name "title" is what the function will be called in the template text.
@@ -270,3 +672,17 @@ func newEnvMappingFromRepoConfig(r RepoConfigMap) envMapping {
 func (envConfig *envMapping) GetNameSpace() string {
 	return (*envConfig)["NAMESPACE"]
 }
+
+// ciBuildURL returns the page of the CI build from the variables the common CI systems set (empty if there's none)
+func ciBuildURL() string {
+	if server, repository, runID := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID"); server != "" && repository != "" && runID != "" {
+		return fmt.Sprintf("%s/%s/actions/runs/%s", server, repository, runID)
+	}
+	// GitLab, CircleCI, Buildkite, Travis CI and Jenkins
+	for _, variable := range []string{"CI_JOB_URL", "CIRCLE_BUILD_URL", "BUILDKITE_BUILD_URL", "TRAVIS_BUILD_WEB_URL", "BUILD_URL"} {
+		if url := os.Getenv(variable); url != "" {
+			return url
+		}
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const changeCauseAnnotation = "kubernetes.io/change-cause"
+
+// kubeDeployAnnotations returns what every object of a rollout is annotated with, to trace it back to who rolled out
+// which commit, from where
+func kubeDeployAnnotations() map[string]string {
+	annotations := map[string]string{
+		"kubedeploy-deployer":    deployer(),
+		gitSHAAnnotation:         repoConfig.GitSHA,
+		"kubedeploy-git-subject": repoConfig.GitCommitSubject,
+		"kubedeploy-git-branch":  repoConfig.GitBranch,
+		"kubedeploy-version":     version,
+		"kubedeploy-config-hash": repoConfig.DeployConfigHash,
+	}
+	if repoConfig.CIBuildURL != "" {
+		annotations["kubedeploy-ci-build-url"] = repoConfig.CIBuildURL
+	}
+	return annotations
+}
+
+// kubeAnnotateObjects adds the annotations of the rollout to every templated object. Deployments and their pod
+// templates also get a 'kubernetes.io/change-cause', which 'kubectl rollout history' shows for each revision.
+func kubeAnnotateObjects(objects []*unstructured.Unstructured) {
+	deployAnnotations := kubeDeployAnnotations()
+	changeCause := fmt.Sprintf("kube-deploy %s: release %s, commit %s (%s) on %s, by %s",
+		version, repoConfig.ReleaseName, repoConfig.GitSHA, repoConfig.GitCommitSubject, repoConfig.GitBranch, deployer())
+
+	for _, object := range objects {
+		annotations := object.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		for key, value := range deployAnnotations {
+			annotations[key] = value
+		}
+		if object.GetKind() == "Deployment" {
+			annotations[changeCauseAnnotation] = changeCause
+			unstructured.SetNestedField(object.Object, changeCause, "spec", "template", "metadata", "annotations", changeCauseAnnotation)
+		}
+		object.SetAnnotations(annotations)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// podTemplateHashLabel is the label which a Deployment gives the pods of each of its ReplicaSets
+const podTemplateHashLabel = "pod-template-hash"
+
+// blueGreen : a blue-green rollout of a Deployment - the main Service, which selects the pods of the live release
+// until the switch, and the preview Service, which selects the pods of the new release from the start
+type blueGreen struct {
+	service          *unstructured.Unstructured
+	preview          *unstructured.Unstructured
+	previousSelector map[string]string // what tells the pods of the previous release apart
+	switched         bool              // whether the main Service selects the new release yet
+}
+
+// prepareBlueGreen pins the main Service to the pods of the previous release, so that applying the files doesn't
+// send any traffic to the new release
+func (w *deploymentWorkload) prepareBlueGreen() error {
+	name := repoConfig.Rollout.BlueGreen.Service
+	service := findObject(w.objects, "Service", name)
+	if service == nil {
+		return fmt.Errorf("the Kubernetes files have no Service %s to switch over to the new release", name)
+	}
+	w.blueGreen = &blueGreen{service: service}
+	w.blueGreen.preview = releaseServiceCopy(service, repoConfig.Rollout.BlueGreen.PreviewService, repoConfig.ReleaseName)
+
+	if w.mostRecentRelease.Name == "" {
+		fmt.Println("=> There's no previous release, so the Service can select the new release straight away.")
+		pinServiceObject(service, map[string]string{releaseLabel: repoConfig.ReleaseName})
+		w.blueGreen.switched = true
+		return nil
+	}
+	selector, err := releaseSelector(&w.mostRecentRelease)
+	if err != nil {
+		return err
+	}
+	pinServiceObject(service, selector)
+	w.blueGreen.previousSelector = selector
+	return nil
+}
+
+// rolloutBlueGreen brings the new release up to its full size, holds at a canary point while it can only be reached
+// through the preview Service, and then switches the main Service over to it. The previous release keeps its pods.
+func (w *deploymentWorkload) rolloutBlueGreen(skipCanary bool) {
+	settings := repoConfig.Rollout.BlueGreen
+	previousRelease := w.mostRecentRelease.Name
+
+	fmt.Printf("=> Bringing the new release up to its %d pod(s), without sending it any traffic yet.\n", w.desiredPods)
+	if !w.scaleNewRelease(w.desiredPods) {
+		w.bailOut()
+	}
+	if err := kubeApplyRouting(w.blueGreen.preview); err != nil {
+		fmt.Printf("=> Oh no, %s\n", err)
+		w.bailOut()
+	}
+	if !skipCanary {
+		fmt.Printf("\n=> The new release can only be reached through the Service %s. Try it out there, and make sure everything looks good.\n", settings.PreviewService)
+		if !previewHold(settings.PreviewSeconds) {
+			w.bailOut()
+		}
+	}
+
+	if !w.blueGreen.switched {
+		fmt.Printf("=> Switching the Service %s over to the new release.\n", settings.Service)
+		pinServiceObject(w.blueGreen.service, map[string]string{releaseLabel: repoConfig.ReleaseName})
+		// Even if the apply failed, the Service may have been switched, so make sure to switch it back
+		w.blueGreen.switched = true
+		if err := kubeApplyRouting(w.blueGreen.service); err != nil {
+			fmt.Printf("=> Oh no, %s\n", err)
+			w.bailOut()
+		}
+		// Only the previous release stands by, so the releases before it don't need their pods any more
+		for _, r := range w.previousReleases.Items {
+			if r.Name != repoConfig.ReleaseName && r.Name != previousRelease && r.Spec.Replicas != nil && *r.Spec.Replicas > 0 {
+				fmt.Printf("=> Scaling down %s, since only the previous release stands by.\n", r.Name)
+				kubeapi.UpdateDeployment(r.Name, func(deployment *appsv1.Deployment) {
+					deployment.Spec.Replicas = new(int32)
+				})
+			}
+		}
+		if !skipCanary {
+			fmt.Printf("\n=> All of the traffic goes to the new release now, and %s is standing by. Watch the monitors, and make sure everything looks good.\n", previousRelease)
+			if !canaryHoldAndWait(settings.SwitchSeconds, repoConfig.ReleaseName, previousRelease) {
+				w.bailOut()
+			}
+		}
+	}
+
+	if err := kubeDeleteRouting(w.blueGreen.preview); err != nil {
+		fmt.Printf("=> Heads up: %s\n", err)
+	}
+}
+
+// previewHold is the canary point before the switch. The new release gets no traffic but that of the people trying it
+// through the preview Service, so the canary analysis would only find no data for it: with an analysis, the rollout just
+// holds for the time, and the analysis checks the new release once the Service switches over to it.
+func previewHold(waitTimeSeconds int) bool {
+	if !repoConfig.Rollout.Analysis.Enabled() {
+		return canaryApproval(waitTimeSeconds)
+	}
+	fmt.Printf("=> The canary analysis starts once the new release gets the traffic, so just waiting %d seconds before the switch.\n", waitTimeSeconds)
+	time.Sleep(time.Duration(waitTimeSeconds) * time.Second)
+	return true
+}
+
+// bailOutBlueGreen switches the main Service back to the previous release, and removes the preview Service
+func (w *deploymentWorkload) bailOutBlueGreen() {
+	if w.blueGreen.switched && w.blueGreen.previousSelector != nil {
+		fmt.Printf("=> Switching the Service %s back to the previous release.\n", w.blueGreen.service.GetName())
+		pinServiceObject(w.blueGreen.service, w.blueGreen.previousSelector)
+		if err := kubeApplyRouting(w.blueGreen.service); err != nil {
+			fmt.Printf("=> Oh no, %s\n", err)
+		}
+	}
+	if err := kubeDeleteRouting(w.blueGreen.preview); err != nil {
+		fmt.Printf("=> Oh no, %s\n", err)
+	}
+}
+
+// kubeBlueGreenRollback switches the main Service back to the rollback target, which keeps its pods after a
+// blue-green rollout. The live release keeps its pods too, so that another rollback switches forward again.
+// Returns false if the rollback failed.
+func kubeBlueGreenRollback(isLive appsv1.Deployment, rollbackTarget appsv1.Deployment) bool {
+	service := repoConfig.Rollout.BlueGreen.Service
+
+	if rollbackTarget.Spec.Replicas == nil || *rollbackTarget.Spec.Replicas <= 0 {
+		replicas := isLive.Spec.Replicas
+		if replicas == nil || *replicas <= 0 {
+			oneReplica := int32(1)
+			replicas = &oneReplica
+		}
+		fmt.Printf("=> %s has no pods to switch to, so scaling it up to %d pods first.\n", rollbackTarget.Name, *replicas)
+		kubeapi.UpdateDeployment(rollbackTarget.Name, func(deployment *appsv1.Deployment) {
+			deployment.Spec.Replicas = replicas
+		})
+		if !kubeapi.WaitForDeploymentRollout(rollbackTarget.Name).Complete {
+			fmt.Printf("=> The pods of %s didn't come up, so I'm leaving the Service %s on %s. You'll need to sort this out by hand.\n", rollbackTarget.Name, service, isLive.Name)
+			return false
+		}
+	}
+
+	fmt.Printf("=> Switching the Service %s back to %s.\n", service, rollbackTarget.Name)
+	if _, err := kubeSwitchService(service, &rollbackTarget, false); err != nil {
+		fmt.Printf("=> Oh no, %s\n", err)
+		return false
+	}
+
+	kubeapi.UpdateDeployment(rollbackTarget.Name, func(deployment *appsv1.Deployment) {
+		deployment.ObjectMeta.Labels["kubedeploy-is-live"] = "true"
+		delete(deployment.ObjectMeta.Labels, "kubedeploy-rollback-target")
+	})
+	kubeapi.UpdateDeployment(isLive.Name, func(deployment *appsv1.Deployment) {
+		deployment.ObjectMeta.Labels["kubedeploy-rollback-target"] = "true"
+		delete(deployment.ObjectMeta.Labels, "kubedeploy-is-live")
+	})
+
+	fmt.Printf("=> The deployment has been successfully rolled back to: %s.\n=> %s keeps its pods, so `kube-deploy rollback` switches back to it again.\n", rollbackTarget.Name, isLive.Name)
+	return true
+}
+
+// releaseSelector returns the pod labels which select only the pods of the release: its 'kubedeploy-release' label,
+// or for releases from before that label, the pod-template-hash of the Deployment's current ReplicaSet
+func releaseSelector(deployment *appsv1.Deployment) (map[string]string, error) {
+	if release := deployment.Spec.Template.Labels[releaseLabel]; release != "" {
+		return map[string]string{releaseLabel: release}, nil
+	}
+
+	hash, currentRevision := "", -1
+	for _, rs := range kubeapi.ListDeploymentReplicaSets(deployment) {
+		revision, err := strconv.Atoi(rs.Annotations["deployment.kubernetes.io/revision"])
+		if err == nil && revision > currentRevision {
+			hash, currentRevision = rs.Labels[podTemplateHashLabel], revision
+		}
+	}
+	if hash == "" {
+		return nil, fmt.Errorf("I can't tell the pods of %s apart from the pods of the other releases", deployment.Name)
+	}
+	return map[string]string{podTemplateHashLabel: hash}, nil
+}
+
+// kubeSwitchService points the Service at the pods of the release. With onlyIfPinned, a Service which selects the
+// pods of every release (eg. since there was no previous release to split the traffic with) is left as it is.
+// Returns whether the Service was switched.
+func kubeSwitchService(name string, release *appsv1.Deployment, onlyIfPinned bool) (bool, error) {
+	selector, err := releaseSelector(release)
+	if err != nil {
+		return false, err
+	}
+	switched := false
+	_, err = kubeapi.UpdateService(name, func(s *corev1.Service) {
+		_, pinnedToRelease := s.Spec.Selector[releaseLabel]
+		_, pinnedToHash := s.Spec.Selector[podTemplateHashLabel]
+		if onlyIfPinned && !pinnedToRelease && !pinnedToHash {
+			return
+		}
+		s.Spec.Selector = pinSelector(s.Spec.Selector, selector)
+		switched = true
+	})
+	return switched, err
+}
+
+// pinSelector returns the Service's selector with the release's labels instead of the labels of another release
+func pinSelector(selector map[string]string, release map[string]string) map[string]string {
+	pinned := map[string]string{}
+	for key, value := range selector {
+		if key != releaseLabel && key != podTemplateHashLabel {
+			pinned[key] = value
+		}
+	}
+	for key, value := range release {
+		pinned[key] = value
+	}
+	return pinned
+}
+
+func pinServiceObject(service *unstructured.Unstructured, release map[string]string) {
+	selector, _, _ := unstructured.NestedStringMap(service.Object, "spec", "selector")
+	unstructured.SetNestedStringMap(service.Object, pinSelector(selector, release), "spec", "selector")
+}
@@ -2,133 +2,207 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
+	"github.com/mycujoo/kube-deploy/analysis"
 	"github.com/mycujoo/kube-deploy/build"
 	"github.com/mycujoo/kube-deploy/cli"
 	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
 
 	appsv1 "k8s.io/api/apps/v1"
-	v1 "k8s.io/api/core/v1"
-	"k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
-const rolloutStatusFormat = "rollout status --namespace=%s deployment/%s"
-
 func kubeStartRollout() {
 
 	if !runFlags.Bool("no-build") {
 		fmt.Println("=> Checking to see if the docker image exists on the remote repository (so we know whether we have to build an image or not).\n=> This might take a minute...")
-		if build.DockerImageExistsRemote(repoConfig.ImageFullPath) {
+		if build.ImageExistsRemote(repoConfig.ImageFullPath, repoConfig) {
 			fmt.Println("=> Looks like an image already exists on the remote, so we'll use that.")
 		} else {
 			fmt.Println("=> No image exists, so we'll build one now.")
 			build.MakeAndPushBuild(
 				runFlags.Bool("force-push-image"),
-				runFlags.Bool("override-dirty-workdir"),
+				gitChecksToSkip(),
 				runFlags.Bool("keep-test-container"),
+				!runFlags.Bool("no-image-reuse"),
+				runFlags.Bool("skip-scan"),
+				runFlags.Bool("skip-tests"),
 				repoConfig,
 			)
 		}
+		if err := build.ResolveImageDigest(&repoConfig); err != nil {
+			log.Fatalf("=> Oh no, %s", err)
+		}
+		build.WriteMetadataFile(repoConfig)
+	} else if metadataFile := runFlags.String("metadata-file"); metadataFile != "" {
+		// Use the digest from the build that happened in an earlier step
+		previousBuild, err := build.ReadMetadataFile(metadataFile, repoConfig)
+		if err != nil {
+			log.Fatalf("=> Oh no, %s", err)
+		}
+		fmt.Printf("=> Using the image %s from the build metadata file.\n", previousBuild.ImageRef)
+		repoConfig.ImageDigest = previousBuild.ImageDigest
+		repoConfig.ImageRef = previousBuild.ImageRef
+		repoConfig.EnvVarsMap["KD_IMAGE_DIGEST"] = previousBuild.ImageDigest
+		repoConfig.EnvVarsMap["KD_IMAGE_REF"] = previousBuild.ImageRef
+	} else if err := build.ResolveImageDigest(&repoConfig); err != nil {
+		fmt.Printf("=> I'll deploy by tag, since %s\n", err)
 	}
 	fmt.Print("=> Starting rollout.\n\n")
+	templatedObjects := kubeTemplatedObjects()
+	kubeAnnotateObjects(templatedObjects)
+	kubeLabelReleaseObjects(templatedObjects)
+	objects, hooks, err := kubeRolloutHooks(templatedObjects)
+	if err != nil {
+		kubeRemoveTemplates()
+		log.Fatalf("=> Uh oh, %s", err)
+	}
+	workload, workloadObject := kubeWorkloadStrategy(objects)
+	if !kubeCanaryPromptsAnswerable() {
+		kubeRemoveTemplates()
+		os.Exit(1)
+	}
 	cli.LockBeforeRollout(repoConfig.Application.Name, runFlags.Bool("force"))
+	historyStart("rollout", "")
+
+	if !kubeRunHooks("pre-rollout", hooks.pre) {
+		kubeBailOutAndExit()
+	}
 
 	skipCanary := runFlags.Bool("no-canary") || runFlags.Bool("force")
+	workload.prepare(workloadObject, skipCanary)
 
-	if existingDeployment := kubeapi.GetSingleDeployment(repoConfig.ReleaseName); existingDeployment.Name != "" {
+	// Apply the templated objects, with any changes the workload strategy made
+	results, err := kubeapi.ApplyObjects(objects)
+	for _, result := range results {
+		fmt.Printf("=> %s\n", result)
+	}
+	kubeRemoveTemplates()
+	if err != nil {
+		fmt.Printf("=> Uh oh, there was a problem applying the Kubernetes files: %s\n=> You should fix this first.\n", err)
+		kubeBailOutAndExit()
+	}
+
+	workload.rollout(skipCanary)
+	postHooksSucceeded := kubeRunHooks("post-rollout", hooks.post)
+
+	// Clean up workdir and remove lockfile
+	kubeRemoveTemplates()
+	cli.UnlockAfterRollout(repoConfig.Application.Name)
+	if !postHooksSucceeded {
+		currentHistory.Detail = "a post-rollout hook failed"
+		historyFinish("failed")
+		log.Fatal("=> The new release is live, but a post-rollout hook failed - you'll need to look into it.\n\n")
+	}
+	historyFinish("succeeded")
+
+	fmt.Print("\n=> You're all done, great job!\n\n")
+}
+
+// deploymentWorkload : the classic kube-deploy rollout, where every release is a new Deployment which takes over
+// from the previous release's Deployment
+type deploymentWorkload struct {
+	objects           []*unstructured.Unstructured // all of the templated objects
+	router            trafficRouter                // nil if the traffic follows the pod counts
+	previousReleases  *appsv1.DeploymentList
+	mostRecentRelease appsv1.Deployment
+	rolloutStartTime  time.Time
+	desiredPods       int32
+	previousPods      int32 // the size of the previous release before the rollout
+	digestVerified    bool
+	blueGreen         *blueGreen                   // nil for the 'canary' strategy
+	manifests         []*unstructured.Unstructured // the templated objects as they are in the files, to store for rollbacks
+	rollbackTo        bool                         // whether the new release is an older release being rolled back to
+}
+
+func (w *deploymentWorkload) prepare(object *unstructured.Unstructured, skipCanary bool) {
+	if existingDeployment := kubeapi.GetSingleDeployment(repoConfig.ReleaseName); existingDeployment.Name != "" && !w.rollbackTo {
 		fmt.Println("=> Looks like there is an existing deployment by this name, so we'll just update/replace it.")
 	}
 
-	previousReleases := kubeapi.ListDeployments(map[string]string{
+	w.previousReleases = kubeapi.ListDeployments(map[string]string{
 		"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch})
-	sort.Slice(previousReleases.Items, func(i, j int) bool {
-		return previousReleases.Items[i].CreationTimestamp.Time.Sub(previousReleases.Items[j].CreationTimestamp.Time) > 0
+	sort.Slice(w.previousReleases.Items, func(i, j int) bool {
+		return w.previousReleases.Items[i].CreationTimestamp.Time.Sub(w.previousReleases.Items[j].CreationTimestamp.Time) > 0
 	})
 	// Find the most recent previous release that doesn't have the same release name (i.e. is not a duplicate of this release)
-	var mostRecentRelease appsv1.Deployment
-	for _, r := range previousReleases.Items {
+	for _, r := range w.previousReleases.Items {
 		if r.Name != repoConfig.ReleaseName {
-			mostRecentRelease = r
+			w.mostRecentRelease = r
 			break
 		}
 	}
-
-	rolloutStartTime := time.Now()
-	// Make the template files, tag deployment with release ID
-	for _, f := range kubeMakeTemplates() {
-		exitCode := cli.StreamAndGetCommandExitCode("kubectl", fmt.Sprintf("apply -f %s", f))
-		if exitCode != 0 {
-			kubeRemoveTemplates()
-			log.Fatal("=> Uh oh, there was an problem during templating. You should fix this first.")
+	// After a rollback, the most recent release isn't the live one - and it's the live release which has the traffic
+	for _, r := range w.previousReleases.Items {
+		if r.Name != repoConfig.ReleaseName && r.Labels["kubedeploy-is-live"] == "true" {
+			w.mostRecentRelease = r
+			break
 		}
 	}
-	kubeRemoveTemplates()
-
-	// Find the just-created deployment
-	thisDeployment := kubeapi.GetSingleDeployment(repoConfig.ReleaseName)
-	desiredPods := *thisDeployment.Spec.Replicas
-	firstCanaryPods := int32(1) // First canary point is one pod only
-
-	// Update with release time and firstCanaryPods replicas
-	thisDeployment = kubeapi.UpdateDeployment(thisDeployment.Name, func(deployment *appsv1.Deployment) {
-		// Add the 'kubedeploy-releasetime' label (which will force the deployment to recreate pods if it already existed)
-		deployment.Spec.Template.ObjectMeta.Labels["kubedeploy-releasetime"] = strconv.FormatInt(rolloutStartTime.Unix(), 10)
-
-		// Quickly scale to only one pod
-		fmt.Printf("=> Scaling to first canary point: %d pod(s)\n", firstCanaryPods)
-		deployment.Spec.Replicas = &firstCanaryPods
-	})
 
-	// Make sure first pod gets started
-	cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf(rolloutStatusFormat, repoConfig.EnvVarsMap.GetNameSpace(), repoConfig.ReleaseName))
+	w.rolloutStartTime = time.Now()
 
-	if !skipCanary {
-		// Pause to watch monitors and make sure that the 1 pod deploy was successful
-		fmt.Println("\n=> Wait for at least one minute to make sure the new pod(s) started okay, and is getting some traffic.")
-		if y := canaryHoldAndWait(60); y == false {
-			safeBailOut(kubeapi.GetSingleDeployment(repoConfig.ReleaseName), &mostRecentRelease, &desiredPods)
+	// The stable and canary Services of a traffic router tell the releases apart by this label
+	if object != nil {
+		unstructured.SetNestedField(object.Object, repoConfig.ReleaseName, "spec", "template", "metadata", "labels", releaseLabel)
+	}
+	switch {
+	case repoConfig.Rollout.Traffic.Router == "":
+	case len(w.objects) == 0:
+		fmt.Println("=> Heads up: there are no Kubernetes files to route the traffic with, so the traffic follows the number of pods of each release.")
+	case w.mostRecentRelease.Name == "":
+		fmt.Println("=> There's no previous release, so there's no traffic to split.")
+	case w.mostRecentRelease.Spec.Template.Labels[releaseLabel] == "":
+		fmt.Printf("=> Heads up: the pods of %s don't have the '%s' label yet, so this time the traffic follows the number of pods of each release.\n", w.mostRecentRelease.Name, releaseLabel)
+	default:
+		w.router = newTrafficRouter(w.mostRecentRelease.Name)
+		if err := w.router.prepare(w.objects); err != nil {
+			fmt.Printf("=> Uh oh, %s\n", err)
+			kubeBailOutAndExit()
 		}
 	}
-
-	if desiredPods > firstCanaryPods { // Skip second canary point if no new pods are needed
-		// Scale up to desired number of pods in new canary release
-		fmt.Printf("=> Scaling to next canary point: %d pod(s)\n=> This should give the new pods roughly 50%% of traffic (if the old deployment was the same size).\n", desiredPods)
-
-		thisDeployment = kubeapi.UpdateDeployment(repoConfig.ReleaseName, func(deployment *appsv1.Deployment) {
-			deployment.Spec.Replicas = &desiredPods
-		})
-		cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf(rolloutStatusFormat, repoConfig.EnvVarsMap.GetNameSpace(), repoConfig.ReleaseName))
-
-		if !skipCanary {
-			fmt.Println("\n=> Now, let's wait for 5 minutes, watch the monitors, and let everything simmer to make sure it looks good.")
-			if y := canaryHoldAndWait(300); y == false {
-				safeBailOut(kubeapi.GetSingleDeployment(repoConfig.ReleaseName), &mostRecentRelease, &desiredPods)
-			}
+	if repoConfig.Rollout.IsBlueGreen() {
+		if err := w.prepareBlueGreen(); err != nil {
+			fmt.Printf("=> Uh oh, %s\n", err)
+			kubeBailOutAndExit()
 		}
 	}
+}
 
-	// Scale down pods in old release
-	if mostRecentRelease.Name != "" {
-		fmt.Println("\n=> Scaling down old deployment, leaving only new deployment pods.")
+func (w *deploymentWorkload) scale(replicas int32) { kubeScaleDeployment(replicas) }
+func (w *deploymentWorkload) rollingRestart()      { kubeRollingRestart() }
+func (w *deploymentWorkload) rollback()            { kubeInstantRollback() }
 
-		mostRecentRelease = *kubeapi.UpdateDeployment(mostRecentRelease.Name, func(deployment *appsv1.Deployment) {
-			deployment.Spec.Replicas = new(int32) // new() returns default value, which is 0 for int32
-		})
-		cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf(rolloutStatusFormat, repoConfig.EnvVarsMap.GetNameSpace(), mostRecentRelease.Name))
+func (w *deploymentWorkload) rollout(skipCanary bool) {
+	mostRecentRelease := w.mostRecentRelease
 
-		if !skipCanary {
-			fmt.Println("=> Now, let's wait for another 5 minutes, watch the monitors again, amd make sure we're confident with the new deployment.")
-			if y := canaryHoldAndWait(300); y == false {
-				safeBailOut(kubeapi.GetSingleDeployment(repoConfig.ReleaseName), kubeapi.GetSingleDeployment(mostRecentRelease.Name), &desiredPods)
+	// Find the just-created deployment
+	thisDeployment := kubeapi.GetSingleDeployment(repoConfig.ReleaseName)
+	if w.desiredPods == 0 {
+		w.desiredPods = *thisDeployment.Spec.Replicas
+	}
+	if mostRecentRelease.Spec.Replicas != nil {
+		w.previousPods = *mostRecentRelease.Spec.Replicas
+	}
+
+	if w.blueGreen != nil {
+		w.rolloutBlueGreen(skipCanary)
+	} else {
+		if w.router != nil {
+			fmt.Printf("=> Setting up the %s canary routing, with no traffic to the new release yet.\n", repoConfig.Rollout.Traffic.Router)
+			if err := w.router.start(); err != nil {
+				fmt.Printf("=> Oh no, %s\n", err)
+				w.bailOut()
 			}
 		}
+		runRolloutPlan(w, skipCanary)
 	}
 
 	// Need to retrieve the deployment again after any kube configs
@@ -158,43 +232,150 @@ func kubeStartRollout() {
 		fmt.Println("=> Since there are no previous deployments, no 'kubedeploy-rollback-target' will be assigned.")
 	}
 
-	// Clean up any older release deployments - leave current new and older
-	for _, r := range previousReleases.Items {
-		if r.Name != thisDeployment.Name && r.Name != mostRecentRelease.Name {
-			fmt.Printf("=> Cleaning up older deployment: %s.\n", r.Name)
-			kubeapi.DeleteDeployment(&r)
+	if len(w.manifests) > 0 {
+		if err := kubeStoreReleaseManifests(w.manifests); err != nil {
+			fmt.Printf("=> Heads up: couldn't store the Kubernetes files of the release, to roll back to later: %s\n", err)
 		}
 	}
 
-	// Clean up workdir and remove lockfile
-	kubeRemoveTemplates()
-	cli.UnlockAfterRollout(repoConfig.Application.Name)
+	kubeCleanUpReleases(thisDeployment.Name, mostRecentRelease.Name)
+	kubePruneReleaseManifests()
+}
 
-	fmt.Print("\n=> You're all done, great job!\n\n")
+func (w *deploymentWorkload) desiredReplicas() int32  { return w.desiredPods }
+func (w *deploymentWorkload) previousReplicas() int32 { return w.previousPods }
+func (w *deploymentWorkload) previousRelease() string { return w.mostRecentRelease.Name }
+
+func (w *deploymentWorkload) scaleNewRelease(replicas int32) bool {
+	kubeapi.UpdateDeployment(repoConfig.ReleaseName, func(deployment *appsv1.Deployment) {
+		// Add the 'kubedeploy-releasetime' label (which will force the deployment to recreate pods if it already existed)
+		deployment.Spec.Template.ObjectMeta.Labels["kubedeploy-releasetime"] = strconv.FormatInt(w.rolloutStartTime.Unix(), 10)
+		deployment.Spec.Replicas = &replicas
+	})
+	if !kubeapi.WaitForDeploymentRollout(repoConfig.ReleaseName).Complete {
+		return false
+	}
+	// Check the digest as soon as the first pods of the new release are up
+	if runFlags.Bool("verify-image-digest") && !w.digestVerified {
+		if !kubeVerifyImageDigest(kubeapi.GetSingleDeployment(repoConfig.ReleaseName)) {
+			return false
+		}
+		w.digestVerified = true
+	}
+	return true
+}
+
+func (w *deploymentWorkload) routeTraffic(weight int, headerOnly bool) bool {
+	switch {
+	case w.router == nil:
+		fmt.Println("=> There's no traffic router for this rollout, so the traffic follows the number of pods of each release.")
+		return true
+	case headerOnly:
+		fmt.Printf("=> Routing only the requests with the '%s: %s' header to the new release.\n", repoConfig.Rollout.Traffic.CanaryHeader, repoConfig.Rollout.Traffic.CanaryHeaderValue)
+	default:
+		fmt.Printf("=> Routing %d%% of the traffic to the new release.\n", weight)
+	}
+	if err := w.router.setWeight(weight, headerOnly); err != nil {
+		fmt.Printf("=> Oh no, %s\n", err)
+		return false
+	}
+	return true
 }
 
-func safeBailOut(thisDeployment *appsv1.Deployment, mostRecentRelease *appsv1.Deployment, pods *int32) {
+func (w *deploymentWorkload) scaleDownPrevious() bool {
+	if w.router != nil {
+		fmt.Println("=> Routing all of the traffic to the new release.")
+		if err := w.router.promote(); err != nil {
+			fmt.Printf("=> Oh no, %s\n", err)
+			return false
+		}
+	}
+	w.mostRecentRelease = *kubeapi.UpdateDeployment(w.mostRecentRelease.Name, func(deployment *appsv1.Deployment) {
+		deployment.Spec.Replicas = new(int32) // new() returns default value, which is 0 for int32
+	})
+	// If the old pods are slow to terminate, that's no reason to undo the rollout
+	kubeapi.WaitForDeploymentRollout(w.mostRecentRelease.Name)
+	return true
+}
+
+func (w *deploymentWorkload) bailOut() {
+	// Once the stable Service selects the new release, the previous release has no pods left, so the traffic can
+	// only go back to it when it's scaled back up
+	routeBack := func() {}
+	switch {
+	case w.router == nil:
+	case w.router.promoted():
+		routeBack = w.abortRouting
+	default:
+		w.abortRouting()
+	}
+	if w.blueGreen != nil {
+		w.bailOutBlueGreen()
+	}
+	safeBailOut(kubeapi.GetSingleDeployment(repoConfig.ReleaseName), &w.mostRecentRelease, &w.desiredPods, !w.rollbackTo, routeBack)
+}
+
+func (w *deploymentWorkload) abortRouting() {
+	fmt.Println("=> Routing all of the traffic back to the previous release.")
+	if err := w.router.abort(); err != nil {
+		fmt.Printf("=> Oh no, %s\n", err)
+	}
+}
+
+// kubeVerifyImageDigest checks that the containers of the deployment's pods which run this app's image
+// were started from the digest that was pushed, and not from some other image pushed with the same tag
+func kubeVerifyImageDigest(deployment *appsv1.Deployment) bool {
+	if repoConfig.ImageDigest == "" {
+		fmt.Println("=> Uh oh, I can't verify the image digest of the pods, since I don't know the digest of the image.")
+		return false
+	}
+
+	fmt.Printf("=> Checking that the pods of %s run the image digest %s.\n", deployment.Name, repoConfig.ImageDigest)
+	verified := true
+	for _, pod := range kubeapi.ListDeploymentPods(deployment) {
+		for _, status := range pod.Status.ContainerStatuses {
+			if !strings.HasPrefix(status.Image, repoConfig.ImageName+":") && !strings.HasPrefix(status.Image, repoConfig.ImageName+"@") {
+				continue // eg. sidecar containers
+			}
+			if !strings.HasSuffix(status.ImageID, "@"+repoConfig.ImageDigest) {
+				fmt.Printf("=> Oh no! Container %s of pod %s runs %s, not the digest that was pushed.\n", status.Name, pod.Name, status.ImageID)
+				verified = false
+			}
+		}
+	}
+	return verified
+}
+
+// safeBailOut scales the previous release back up, routes the traffic back to it, and deletes the new release - or
+// with deleteThisRelease false (for a release being rolled back to), scales it back down to 0
+func safeBailOut(thisDeployment *appsv1.Deployment, mostRecentRelease *appsv1.Deployment, pods *int32, deleteThisRelease bool, routeBack func()) {
 	fmt.Println("=> Okay, let's try and bail out safely.")
 
 	if mostRecentRelease.Name != "" {
-		fmt.Printf("=> Scaling the previous release %s back up to %d pods.\n", mostRecentRelease.Name, pods)
+		fmt.Printf("=> Scaling the previous release %s back up to %d pods.\n", mostRecentRelease.Name, *pods)
 		kubeapi.UpdateDeployment(mostRecentRelease.Name, func(deployment *appsv1.Deployment) {
 			deployment.Spec.Replicas = pods
 			deployment.ObjectMeta.Labels["kubedeploy-is-live"] = "true"
 			delete(deployment.ObjectMeta.Labels, "kubedeploy-rollback-target")
 		})
-		cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf(rolloutStatusFormat, repoConfig.EnvVarsMap.GetNameSpace(), mostRecentRelease.Name))
+		kubeapi.WaitForDeploymentRollout(mostRecentRelease.Name)
+		routeBack()
 
-		fmt.Println("=> Deleting the deployment we created...")
-		kubeapi.DeleteDeployment(thisDeployment)
+		if deleteThisRelease {
+			fmt.Println("=> Deleting the deployment we created...")
+			kubeapi.DeleteDeployment(thisDeployment)
+		} else {
+			fmt.Printf("=> Scaling %s back down to 0 pods.\n", thisDeployment.Name)
+			kubeapi.UpdateDeployment(thisDeployment.Name, func(deployment *appsv1.Deployment) {
+				deployment.Spec.Replicas = new(int32)
+			})
+		}
 	} else {
 		// There was no 'most recent' release
 		fmt.Println("=> Oh no, I don't have anywhere to roll back to! I'll leave things as they are now, but you'll need to clean up yourself, or do another rollout forward.")
 	}
 
-	kubeRemoveTemplates()
-	cli.UnlockAfterRollout(repoConfig.Application.Name)
-	log.Fatal("=> Sorry it didn't work out - better luck next time!\n\n")
+	kubeBailOutAndExit()
 }
 
 func kubeRollingRestart() {
@@ -205,14 +386,17 @@ func kubeRollingRestart() {
 		for _, i := range isLiveDeployments.Items {
 			fmt.Printf("\t%s\n", i.Name)
 		}
-		os.Exit(1)
+		exitWithHistory()
 	}
 
 	isLive := isLiveDeployments.Items[0]
+	historySetRelease(isLive.Name, releaseGitSHA(isLive.Name))
 	kubeapi.UpdateDeployment(isLive.Name, func(deployment *appsv1.Deployment) {
 		deployment.Spec.Template.ObjectMeta.Labels["kubedeploy-last-rolling-restart"] = strconv.FormatInt(time.Now().Unix(), 10)
 	})
-	cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf(rolloutStatusFormat, repoConfig.EnvVarsMap.GetNameSpace(), isLive.Name))
+	if !kubeapi.WaitForDeploymentRollout(isLive.Name).Complete {
+		exitWithHistory()
+	}
 
 	fmt.Printf("\n=> All pods have been recreated.\n\n")
 }
@@ -230,29 +414,72 @@ func kubeInstantRollback() {
 		for _, i := range rollbackTargets.Items {
 			fmt.Printf("\t%s\n", i.Name)
 		}
-		os.Exit(1)
+		exitWithHistory()
 	}
 
 	isLive := isLiveDeployments.Items[0]
+	if repoConfig.Rollout.IsBlueGreen() {
+		historySetRelease(rollbackTargets.Items[0].Name, releaseGitSHA(rollbackTargets.Items[0].Name))
+		if !kubeBlueGreenRollback(isLive, rollbackTargets.Items[0]) {
+			exitWithHistory()
+		}
+		return
+	}
 	replicas := isLive.Spec.Replicas
 	if int(*replicas) <= 0 {
 		oneReplica := int32(1)
 		replicas = &oneReplica
 	}
 
+	if !kubeCanaryPromptsAnswerable() {
+		exitWithHistory()
+	}
 	rollbackTarget := rollbackTargets.Items[0]
+	historySetRelease(rollbackTarget.Name, releaseGitSHA(rollbackTarget.Name))
 	rollbackTarget.Spec.Replicas = replicas
 	fmt.Printf("=> Rolling back to %s, pod count %d.\n", rollbackTarget.Name, *replicas)
 
 	kubeapi.UpdateDeployment(rollbackTarget.Name, func(deployment *appsv1.Deployment) {
+		deployment.Spec.Replicas = replicas
 		deployment.ObjectMeta.Labels["kubedeploy-is-live"] = "true"
 		delete(deployment.ObjectMeta.Labels, "kubedeploy-rollback-target")
 	})
-	cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf(rolloutStatusFormat, repoConfig.EnvVarsMap.GetNameSpace(), rollbackTarget.Name))
+	if !kubeapi.WaitForDeploymentRollout(rollbackTarget.Name).Complete {
+		fmt.Printf("=> The pods of %s didn't come up, so I'm leaving %s running. You'll need to sort this out by hand.\n", rollbackTarget.Name, isLive.Name)
+		exitWithHistory()
+	}
+
+	// With a traffic router, the Service selects only the pods of the live release, so it has to be switched too
+	service, switched := repoConfig.Rollout.Traffic.Service, false
+	if repoConfig.Rollout.Traffic.Router != "" {
+		var err error
+		if switched, err = kubeSwitchService(service, &rollbackTarget, true); err != nil {
+			fmt.Printf("=> Oh no, %s\n=> I'm leaving %s running. You'll need to sort this out by hand.\n", err, isLive.Name)
+			exitWithHistory()
+		}
+		if switched {
+			fmt.Printf("=> Switched the Service %s over to %s.\n", service, rollbackTarget.Name)
+		}
+	}
 
 	if !runFlags.Bool("force") && !runFlags.Bool("no-canary") {
 		fmt.Println("\n=> Wait for one minute to make sure that the old pods came up correctly.")
-		canaryHoldAndWait(60)
+		if !canaryHoldAndWait(60, rollbackTarget.Name, isLive.Name) {
+			fmt.Printf("=> Okay, %s stays live.\n", isLive.Name)
+			if switched {
+				fmt.Printf("=> Switching the Service %s back to %s.\n", service, isLive.Name)
+				if _, err := kubeSwitchService(service, &isLive, false); err != nil {
+					fmt.Printf("=> Oh no, %s\n", err)
+				}
+			}
+			fmt.Printf("=> Scaling %s back down to 0 pods.\n", rollbackTarget.Name)
+			kubeapi.UpdateDeployment(rollbackTarget.Name, func(deployment *appsv1.Deployment) {
+				deployment.Spec.Replicas = new(int32)
+				deployment.ObjectMeta.Labels["kubedeploy-rollback-target"] = "true"
+				delete(deployment.ObjectMeta.Labels, "kubedeploy-is-live")
+			})
+			exitWithHistory()
+		}
 	}
 
 	// Scale old pods down to zero
@@ -263,7 +490,7 @@ func kubeInstantRollback() {
 	})
 
 	fmt.Println("=> Wait for the old pods to scale down to 0.")
-	cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf(rolloutStatusFormat, repoConfig.EnvVarsMap.GetNameSpace(), rollbackTarget.Name))
+	kubeapi.WaitForDeploymentRollout(isLive.Name)
 
 	fmt.Printf("=> The deployment has been successfully rolled back to: %s.\n", rollbackTarget.Name)
 }
@@ -273,51 +500,60 @@ func kubeScaleDeployment(replicas int32) {
 	if len(deployments.Items) == 1 {
 		fmt.Printf("=> Starting to scale to %d replica(s).\n", replicas)
 		liveDeployment := deployments.Items[0]
+		historySetRelease(liveDeployment.Name, releaseGitSHA(liveDeployment.Name))
 
 		kubeapi.UpdateDeployment(liveDeployment.Name, func(deployment *appsv1.Deployment) {
 			deployment.Spec.Replicas = &replicas
 		})
-		cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf(rolloutStatusFormat, repoConfig.EnvVarsMap.GetNameSpace(), repoConfig.ReleaseName))
+		if !kubeapi.WaitForDeploymentRollout(liveDeployment.Name).Complete {
+			exitWithHistory()
+		}
 		fmt.Printf("=> Finished scaling to %d replica(s).\n", replicas)
 	} else {
 		fmt.Println("=> Whoah, there's more than one 'is_live' deployment. You should fix that first.")
 		for _, i := range deployments.Items {
 			fmt.Printf("\t%s\n", i.Name)
 		}
-		os.Exit(1)
+		exitWithHistory()
 	}
 }
 
+// kubeRemove deletes every object in the Kubernetes files from the cluster, whatever its kind, after a confirmation
 func kubeRemove() {
-	cli.LockBeforeRollout(repoConfig.Application.Name, runFlags.Bool("force"))
+	objects := kubeTemplatedObjects()
+	kubeRemoveTemplates()
+	dryRun := runFlags.Bool("dry-run")
 
-	for _, f := range kubeMakeTemplates() {
-		fileData, err := ioutil.ReadFile(f)
-		if err != nil {
-			fmt.Println("Coud not read template file to remove.")
-		}
-		kubeObject := kubeapi.ParseKubeFile(fileData)
-
-		switch o := kubeObject.(type) {
-		case *appsv1.Deployment:
-			deployment := kubeObject.(*appsv1.Deployment)
-			kubeapi.DeleteDeployment(deployment)
-		case *v1.Service:
-			service := kubeObject.(*v1.Service)
-			kubeapi.DeleteService(service)
-		case *v1.Secret:
-			secret := kubeObject.(*v1.Secret)
-			kubeapi.DeleteSecret(secret)
-		case *v1beta1.Ingress:
-			ingress := kubeObject.(*v1beta1.Ingress)
-			kubeapi.DeleteIngress(ingress)
-		default:
-			log.Fatalf("=> Unable to delete Kubernetes object of type: ", o)
+	fmt.Println("=> These objects from the Kubernetes files will be removed:")
+	for _, object := range objects {
+		namespace := object.GetNamespace()
+		if namespace == "" {
+			namespace = repoConfig.EnvVarsMap.GetNameSpace()
 		}
+		fmt.Printf("\t%s %s (namespace %s)\n", object.GetKind(), object.GetName(), namespace)
+	}
+	if dryRun {
+		fmt.Println("=> This is a dry run: the API server checks every deletion, but nothing is removed.")
+	} else if err := cli.CheckPromptsAnswerable("remove"); err != nil {
+		log.Fatalf("=> Uh oh, %s", err)
+	} else if !cli.AskToProceed("remove", "Are you sure you want to remove all of them?") {
+		fmt.Println("=> Okay, nothing was removed.")
+		return
 	}
 
-	kubeRemoveTemplates()
+	cli.LockBeforeRollout(repoConfig.Application.Name, runFlags.Bool("force"))
+	results, errs := kubeapi.DeleteObjects(objects, dryRun)
 	cli.UnlockAfterRollout(repoConfig.Application.Name)
+
+	for _, result := range results {
+		fmt.Printf("=> %s\n", result)
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Printf("=> Oh no, %s\n", err)
+		}
+		os.Exit(1)
+	}
 }
 
 func kubeListDeployments() {
@@ -332,16 +568,64 @@ func kubeListDeployments() {
 	w.Flush()
 }
 
-func canaryHoldAndWait(waitTimeSeconds int) bool {
+// kubeCanaryPromptsAnswerable checks that the canary points can be answered, before anything changes: without a
+// canary analysis (which answers them itself) or '--no-canary', a non-interactive run needs a default answer
+func kubeCanaryPromptsAnswerable() bool {
+	if runFlags.Bool("no-canary") || runFlags.Bool("force") || repoConfig.Rollout.Analysis.Enabled() {
+		return true
+	}
+	if err := cli.CheckPromptsAnswerable("canary"); err != nil {
+		fmt.Printf("=> Uh oh, %s\n", err)
+		return false
+	}
+	return true
+}
+
+// canaryHoldAndWait holds the rollout at a canary point: with a canary analysis configured, until the metrics
+// have been checked for the whole time, and otherwise until someone says it looks good (and waited long enough)
+func canaryHoldAndWait(waitTimeSeconds int, release string, previousRelease string) bool {
+	if repoConfig.Rollout.Analysis.Enabled() {
+		return canaryAnalysis(waitTimeSeconds, release, previousRelease)
+	}
+	return canaryApproval(waitTimeSeconds)
+}
+
+// canaryAnalysis checks the metrics of the 'rollout.analysis' for the release taking over (the new release, or the
+// one rolled back to) during the whole time
+func canaryAnalysis(waitTimeSeconds int, release string, previousRelease string) bool {
+	passed := analysis.RunCanaryAnalysis(repoConfig.Rollout.Analysis, analysis.TemplateVars{
+		Release:         release,
+		PreviousRelease: previousRelease,
+		App:             repoConfig.EnvVarsMap["KD_APP_NAME"],
+		Namespace:       repoConfig.EnvVarsMap.GetNameSpace(),
+	}, time.Duration(waitTimeSeconds)*time.Second)
+	historyCanaryDecision("analysis", passed)
+	return passed
+}
+
+// canaryApproval asks whether to go on, and makes sure the canary had at least the given time
+func canaryApproval(waitTimeSeconds int) bool {
+	passed := askCanaryApproval(waitTimeSeconds)
+	historyCanaryDecision("approval", passed)
+	return passed
+}
+
+func askCanaryApproval(waitTimeSeconds int) bool {
 	firstPromptTime := time.Now()
 	printablePromptTime := firstPromptTime.Format("Jan _2 15:04:05")
-	proceed := askToProceed(fmt.Sprintf("%s: You are at a canary point.", printablePromptTime))
+	proceed := cli.AskToProceed("canary", fmt.Sprintf("%s: You are at a canary point.", printablePromptTime))
 	if proceed == false {
 		return false
 	}
 	elasped := int(time.Since(firstPromptTime).Seconds())
 	if elasped < waitTimeSeconds {
-		proceed := askToProceed("=> Bad behaviour - you're back too quickly. Honestly, are you really sure?")
+		if !cli.Interactive() {
+			// Nobody is watching the monitors, so at least give the canary the full time before moving on
+			fmt.Printf("=> Waiting the rest of the %d seconds before moving on.\n", waitTimeSeconds)
+			time.Sleep(time.Duration(waitTimeSeconds-elasped) * time.Second)
+			return true
+		}
+		proceed := cli.AskToProceed("canary-too-soon", "Bad behaviour - you're back too quickly. Honestly, are you really sure?")
 		return proceed
 	}
 	return true
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// previousImagesAnnotation records the container images a CronJob had before the latest rollout, to roll back to
+const previousImagesAnnotation = "kubedeploy-previous-images"
+
+// verificationRunDeadline limits how long the verification run of a CronJob can take, if its job template doesn't
+var verificationRunDeadline = int64(3600)
+
+// cronJobWorkload : swaps the image of a CronJob, then verifies it by running the job once straight away
+type cronJobWorkload struct {
+	name    string
+	existed bool
+}
+
+func (w *cronJobWorkload) prepare(object *unstructured.Unstructured, skipCanary bool) {
+	existing, err := kubeapi.GetCronJob(w.name)
+	if errors.IsNotFound(err) {
+		fmt.Printf("=> This is the first rollout of cronjob %s.\n", w.name)
+		return
+	} else if err != nil {
+		log.Fatalf("=> Oh no, couldn't get cronjob %s: %s", w.name, err)
+	}
+	w.existed = true
+
+	annotations := object.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[previousImagesAnnotation] = cronJobImages(existing)
+	object.SetAnnotations(annotations)
+}
+
+func (w *cronJobWorkload) rollout(skipCanary bool) {
+	if skipCanary {
+		fmt.Println("=> Skipping the verification run of the cronjob.")
+		return
+	}
+
+	cronJob, err := kubeapi.GetCronJob(w.name)
+	if err != nil {
+		log.Fatalf("=> Oh no, couldn't get cronjob %s: %s", w.name, err)
+	}
+	// The same as 'kubectl create job --from=cronjob/...'
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%.40s-verify-%d", w.name, time.Now().Unix()),
+			Labels:      cronJob.Spec.JobTemplate.Labels,
+			Annotations: map[string]string{"cronjob.kubernetes.io/instantiate": "manual"},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(cronJob, batchv1beta1.SchemeGroupVersion.WithKind("CronJob")),
+			},
+		},
+		Spec: cronJob.Spec.JobTemplate.Spec,
+	}
+	if job.Spec.ActiveDeadlineSeconds == nil {
+		job.Spec.ActiveDeadlineSeconds = &verificationRunDeadline
+	}
+
+	fmt.Println("=> Running the cronjob once now, to verify the new release.")
+	succeeded, err := kubeapi.RunJob(repoConfig.EnvVarsMap.GetNameSpace(), job, "")
+	if err != nil {
+		fmt.Printf("=> Oh no, %s\n", err)
+	}
+	if !succeeded {
+		fmt.Printf("=> Oh no, the verification run failed. The job %s is left in place, so you can look into it.\n", job.Name)
+		w.bailOut()
+	}
+	kubeapi.DeleteJob(repoConfig.EnvVarsMap.GetNameSpace(), job.Name)
+	fmt.Println("=> The verification run succeeded.")
+}
+
+// bailOut puts the images from before the rollout back into the cronjob
+func (w *cronJobWorkload) bailOut() {
+	fmt.Println("=> Okay, let's try and bail out safely.")
+	if !w.existed {
+		fmt.Println("=> Oh no, I don't have anywhere to roll back to! I'll leave things as they are now, but you'll need to clean up yourself, or do another rollout forward.")
+	} else if err := w.swapToPreviousImages(); err != nil {
+		fmt.Printf("=> Oh no, rolling back failed: %s\n=> You'll need to clean up yourself.\n", err)
+	}
+	kubeBailOutAndExit()
+}
+
+// swapToPreviousImages puts the images from before the latest rollout back, and records the current ones instead,
+// so that rolling back twice swaps back again
+func (w *cronJobWorkload) swapToPreviousImages() error {
+	cronJob, err := kubeapi.GetCronJob(w.name)
+	if err != nil {
+		return err
+	}
+	previousImages := map[string]string{}
+	if err := json.Unmarshal([]byte(cronJob.Annotations[previousImagesAnnotation]), &previousImages); err != nil {
+		return fmt.Errorf("cronjob %s doesn't record its previous images", w.name)
+	}
+
+	kubeapi.UpdateCronJob(w.name, func(cronJob *batchv1beta1.CronJob) {
+		cronJob.Annotations[previousImagesAnnotation] = cronJobImages(cronJob)
+		containers := cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers
+		for i := range containers {
+			if image, ok := previousImages[containers[i].Name]; ok {
+				fmt.Printf("=> Container %s: %s\n", containers[i].Name, image)
+				containers[i].Image = image
+			}
+		}
+	})
+	return nil
+}
+
+func (w *cronJobWorkload) scale(replicas int32) {
+	fmt.Println("=> Sorry, a cronjob starts its pods on a schedule, so it can't be scaled.")
+	exitWithHistory()
+}
+
+func (w *cronJobWorkload) rollingRestart() {
+	fmt.Println("=> Every run of a cronjob starts new pods already, so there's nothing to restart.")
+	exitWithHistory()
+}
+
+func (w *cronJobWorkload) rollback() {
+	if err := w.swapToPreviousImages(); err != nil {
+		fmt.Printf("=> Oh no, %s\n", err)
+		exitWithHistory()
+	}
+	fmt.Printf("=> Cronjob %s has been rolled back - its next run uses the images above.\n", w.name)
+}
+
+// cronJobImages returns the image of each container in the cronjob, by container name, as JSON
+func cronJobImages(cronJob *batchv1beta1.CronJob) string {
+	images := map[string]string{}
+	for _, container := range cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers {
+		images[container.Name] = container.Image
+	}
+	imagesJSON, _ := json.Marshal(images)
+	return string(imagesJSON)
+}
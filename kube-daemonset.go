@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// daemonSetWorkload : rolls out a DaemonSet in place, node by node (as many at a time as its maxUnavailable allows).
+// There's one pod per node, so there's no canary pod - the canary point comes once all nodes run the new release.
+type daemonSetWorkload struct {
+	name             string
+	existed          bool
+	previousRevision string // the ControllerRevision of the template the pods ran before this rollout
+}
+
+func (w *daemonSetWorkload) prepare(object *unstructured.Unstructured, skipCanary bool) {
+	existing, err := kubeapi.GetDaemonSet(w.name)
+	if errors.IsNotFound(err) {
+		fmt.Printf("=> This is the first rollout of daemonset %s.\n", w.name)
+	} else if err != nil {
+		log.Fatalf("=> Oh no, couldn't get daemonset %s: %s", w.name, err)
+	} else {
+		w.existed = true
+		if w.previousRevision, err = kubeapi.CurrentRevision("DaemonSet", existing.Name); err != nil {
+			log.Fatalf("=> Oh no, couldn't get the revisions of daemonset %s: %s", w.name, err)
+		}
+	}
+
+	strategy, _, _ := unstructured.NestedString(object.Object, "spec", "updateStrategy", "type")
+	if strategy == string(appsv1.OnDeleteDaemonSetStrategyType) {
+		fmt.Println("=> Heads up: this daemonset uses the 'OnDelete' update strategy, so its pods only change when you delete them.")
+		return
+	}
+	maxUnavailable, found, _ := unstructured.NestedFieldNoCopy(object.Object, "spec", "updateStrategy", "rollingUpdate", "maxUnavailable")
+	if !found {
+		maxUnavailable = 1 // the Kubernetes default
+	}
+	fmt.Printf("=> The pods will be updated on %v node(s) at a time (the daemonset's maxUnavailable).\n", maxUnavailable)
+}
+
+func (w *daemonSetWorkload) rollout(skipCanary bool) {
+	if !kubeapi.WaitForDaemonSetRollout(w.name).Complete {
+		w.bailOut()
+	}
+	if w.existed && !skipCanary {
+		fmt.Println("\n=> Now, let's wait for 5 minutes, watch the monitors, and let everything simmer to make sure it looks good.")
+		if y := canaryHoldAndWait(300, repoConfig.ReleaseName, ""); y == false {
+			w.bailOut()
+		}
+	}
+}
+
+// bailOut puts the pods back on the template they ran before the rollout
+func (w *daemonSetWorkload) bailOut() {
+	fmt.Println("=> Okay, let's try and bail out safely.")
+	current, err := kubeapi.CurrentRevision("DaemonSet", w.name)
+	switch {
+	case !w.existed:
+		fmt.Println("=> Oh no, I don't have anywhere to roll back to! I'll leave things as they are now, but you'll need to clean up yourself, or do another rollout forward.")
+	case err != nil:
+		fmt.Printf("=> Oh no, couldn't get daemonset %s: %s\n", w.name, err)
+	case current == w.previousRevision:
+		fmt.Println("=> The pod template didn't change, so there's nothing to roll back.")
+	default:
+		if err := kubeapi.RollBackToRevision("DaemonSet", w.name, w.previousRevision); err != nil {
+			fmt.Printf("=> Oh no, rolling back failed: %s\n=> You'll need to clean up yourself.\n", err)
+			break
+		}
+		kubeapi.WaitForDaemonSetRollout(w.name)
+	}
+	kubeBailOutAndExit()
+}
+
+func (w *daemonSetWorkload) scale(replicas int32) {
+	fmt.Println("=> Sorry, a daemonset runs one pod on every node, so it can't be scaled.")
+	exitWithHistory()
+}
+
+func (w *daemonSetWorkload) rollingRestart() {
+	kubeapi.UpdateDaemonSet(w.name, func(daemonSet *appsv1.DaemonSet) {
+		if daemonSet.Spec.Template.ObjectMeta.Labels == nil {
+			daemonSet.Spec.Template.ObjectMeta.Labels = map[string]string{}
+		}
+		daemonSet.Spec.Template.ObjectMeta.Labels["kubedeploy-last-rolling-restart"] = strconv.FormatInt(time.Now().Unix(), 10)
+	})
+	if !kubeapi.WaitForDaemonSetRollout(w.name).Complete {
+		exitWithHistory()
+	}
+
+	fmt.Printf("\n=> All pods have been recreated.\n\n")
+}
+
+func (w *daemonSetWorkload) rollback() {
+	if err := kubeapi.RollBackToPreviousRevision("DaemonSet", w.name); err != nil {
+		fmt.Printf("=> Oh no, %s\n", err)
+		exitWithHistory()
+	}
+	if !kubeapi.WaitForDaemonSetRollout(w.name).Complete {
+		exitWithHistory()
+	}
+	fmt.Printf("=> Daemonset %s has been successfully rolled back.\n", w.name)
+}
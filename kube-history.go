@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// historyLabel marks the ConfigMap which holds the history of an app's rollouts, rollbacks, etc.
+	historyLabel = "kubedeploy-history"
+	historyKey   = "history.json"
+)
+
+// historyRecordsToKeep keeps the history ConfigMap well below the size limit of a ConfigMap
+var historyRecordsToKeep = 200
+
+// historyRecord : one rollout, rollback, scale or restart of the app
+type historyRecord struct {
+	ID              string           `json:"id"`
+	Action          string           `json:"action"` // 'rollout', 'rollback', 'scale' or 'rolling-restart'
+	Release         string           `json:"release"`
+	Image           string           `json:"image,omitempty"`
+	ImageDigest     string           `json:"imageDigest,omitempty"`
+	GitSHA          string           `json:"gitSHA,omitempty"`
+	Deployer        string           `json:"deployer"`
+	Started         time.Time        `json:"started"`
+	Finished        *time.Time       `json:"finished,omitempty"`
+	Outcome         string           `json:"outcome"`          // 'succeeded' or 'failed' ('unfinished' until then)
+	Detail          string           `json:"detail,omitempty"` // eg. the number of pods for 'scale'
+	CanaryDecisions []canaryDecision `json:"canaryDecisions,omitempty"`
+}
+
+// canaryDecision : how a canary point was decided
+type canaryDecision struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"` // 'analysis' or 'approval'
+	Passed bool      `json:"passed"`
+}
+
+// currentHistory is the record of what this run of kube-deploy is doing (nil if it isn't recorded)
+var currentHistory *historyRecord
+
+// historyStart records the start of an action. The record is written straight away, so that an action which never
+// finished still shows up.
+func historyStart(action string, detail string) {
+	currentHistory = &historyRecord{
+		Action:   action,
+		Deployer: deployer(),
+		Started:  time.Now().UTC(),
+		Outcome:  "unfinished",
+		Detail:   detail,
+	}
+	currentHistory.ID = currentHistory.Started.Format(time.RFC3339Nano)
+	if action == "rollout" {
+		currentHistory.Release = repoConfig.ReleaseName
+		currentHistory.Image = repoConfig.ImageFullPath
+		currentHistory.ImageDigest = repoConfig.ImageDigest
+		currentHistory.GitSHA = repoConfig.GitSHA
+	}
+	writeHistory()
+}
+
+// historySetRelease records which release an action was about, once it's known (eg. the release rolled back to)
+func historySetRelease(release string, gitSHA string) {
+	if currentHistory == nil {
+		return
+	}
+	currentHistory.Release, currentHistory.GitSHA = release, gitSHA
+	currentHistory.Image, currentHistory.ImageDigest = "", ""
+}
+
+func historyCanaryDecision(method string, passed bool) {
+	if currentHistory == nil {
+		return
+	}
+	currentHistory.CanaryDecisions = append(currentHistory.CanaryDecisions, canaryDecision{Time: time.Now().UTC(), Method: method, Passed: passed})
+	writeHistory()
+}
+
+// historyFinish records the outcome of the action
+func historyFinish(outcome string) {
+	if currentHistory == nil {
+		return
+	}
+	finished := time.Now().UTC()
+	currentHistory.Finished = &finished
+	currentHistory.Outcome = outcome
+	writeHistory()
+	currentHistory = nil
+}
+
+func historyConfigMapName() string {
+	return fmt.Sprintf("%.230s-kubedeploy-history", repoConfig.Application.Name+"-"+repoConfig.GitBranch)
+}
+
+// writeHistory adds or updates the current record in the app's history ConfigMap. The history is only a record,
+// so a problem writing it never stops the action.
+func writeHistory() {
+	labels := map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch, historyLabel: "true"}
+	err := kubeapi.UpdateConfigMapData(historyConfigMapName(), labels, func(data map[string]string) error {
+		var records []historyRecord
+		if data[historyKey] != "" {
+			if err := json.Unmarshal([]byte(data[historyKey]), &records); err != nil {
+				return fmt.Errorf("the history in the ConfigMap %s can't be read, so I'm leaving it as it is: %s", historyConfigMapName(), err)
+			}
+		}
+
+		updated := false
+		for i := range records {
+			if records[i].ID == currentHistory.ID {
+				records[i], updated = *currentHistory, true
+			}
+		}
+		if !updated {
+			records = append(records, *currentHistory)
+		}
+		if len(records) > historyRecordsToKeep {
+			records = records[len(records)-historyRecordsToKeep:]
+		}
+		recordsJSON, _ := json.Marshal(records)
+		data[historyKey] = string(recordsJSON)
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("=> Heads up: couldn't record this in the history: %s\n", err)
+	}
+}
+
+func readHistory() ([]historyRecord, error) {
+	configMap, err := kubeapi.GetConfigMap(historyConfigMapName())
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []historyRecord
+	if err := json.Unmarshal([]byte(configMap.Data[historyKey]), &records); err != nil {
+		return nil, fmt.Errorf("the history in the ConfigMap %s can't be read: %s", configMap.Name, err)
+	}
+	return records, nil
+}
+
+// kubeShowHistory prints the history of the app, the most recent first - as a table, or as JSON with '--json'
+func kubeShowHistory() {
+	records, err := readHistory()
+	if err != nil {
+		fmt.Printf("=> Uh oh, %s\n", err)
+		os.Exit(1)
+	}
+	// Most recent first
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+
+	if runFlags.Bool("json") {
+		if records == nil {
+			records = []historyRecord{}
+		}
+		recordsJSON, _ := json.MarshalIndent(records, "", "  ")
+		fmt.Fprintln(osstdout, string(recordsJSON))
+		return
+	}
+
+	if len(records) == 0 {
+		fmt.Println("=> Nothing has been recorded for this app and branch yet.")
+		return
+	}
+	w := tabwriter.NewWriter(osstdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Started\tAction\tRelease\tGit SHA\tDeployer\tDuration\tOutcome\tCanary Points\tDetail")
+	for _, r := range records {
+		duration := "-"
+		if r.Finished != nil {
+			duration = r.Finished.Sub(r.Started).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Started.Local().Format("2006-01-02 15:04:05"), r.Action, r.Release, r.GitSHA, r.Deployer, duration, r.Outcome,
+			canarySummary(r.CanaryDecisions), r.Detail)
+	}
+	w.Flush()
+}
+
+// canarySummary sums up the canary points, eg. '2 passed, 1 failed'
+func canarySummary(decisions []canaryDecision) string {
+	passed, failed := 0, 0
+	for _, decision := range decisions {
+		if decision.Passed {
+			passed++
+		} else {
+			failed++
+		}
+	}
+	var summary []string
+	if passed > 0 {
+		summary = append(summary, fmt.Sprintf("%d passed", passed))
+	}
+	if failed > 0 {
+		summary = append(summary, fmt.Sprintf("%d failed", failed))
+	}
+	if len(summary) == 0 {
+		return "-"
+	}
+	return strings.Join(summary, ", ")
+}
+
+// exitWithHistory records the action as failed, and exits - for 'scale', 'rollback' and 'rolling-restart', which
+// have no lock to release
+func exitWithHistory() {
+	historyFinish("failed")
+	os.Exit(1)
+}
+
+// deployer is who runs kube-deploy - the same as the author of the lockfile
+func deployer() string {
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return "unknown"
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// hookLabel is the label of every run of a hook Job, with the name of the Job from the Kubernetes files
+const hookLabel = "kubedeploy-hook"
+
+// hookRunDeadline limits how long a hook Job can run, if it doesn't have a deadline of its own
+var hookRunDeadline = int64(3600)
+
+// rolloutHooks : the Jobs from the Kubernetes files which run before and after the rollout, in the order of the
+// 'rollout.hooks'
+type rolloutHooks struct {
+	pre  []*batchv1.Job
+	post []*batchv1.Job
+}
+
+// kubeRolloutHooks takes the hook Jobs out of the templated objects, since they're run instead of applied
+func kubeRolloutHooks(objects []*unstructured.Unstructured) ([]*unstructured.Unstructured, rolloutHooks, error) {
+	var hooks rolloutHooks
+	hookJobs := map[string]*unstructured.Unstructured{}
+	for _, hook := range repoConfig.Rollout.Hooks {
+		hookJobs[hook.Job] = nil
+	}
+
+	var applied []*unstructured.Unstructured
+	for _, object := range objects {
+		if _, ok := hookJobs[object.GetName()]; ok && object.GetKind() == "Job" {
+			hookJobs[object.GetName()] = object
+		} else {
+			applied = append(applied, object)
+		}
+	}
+
+	for _, hook := range repoConfig.Rollout.Hooks {
+		object := hookJobs[hook.Job]
+		if object == nil {
+			return nil, hooks, fmt.Errorf("the Kubernetes files have no Job %s for the %s hook", hook.Job, hook.Phase)
+		}
+		job := &batchv1.Job{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, job); err != nil {
+			return nil, hooks, fmt.Errorf("the %s hook %s isn't a valid Job: %s", hook.Phase, hook.Job, err)
+		}
+		if hook.Phase == "pre-rollout" {
+			hooks.pre = append(hooks.pre, job)
+		} else {
+			hooks.post = append(hooks.post, job)
+		}
+	}
+	return applied, hooks, nil
+}
+
+// kubeRunHooks runs the hook Jobs one after the other, streaming their logs, and stops at the first one that fails.
+// The failed run is left in place to look into; older runs are cleaned up down to the 'rollout.hookRunsToKeep'.
+func kubeRunHooks(phase string, jobs []*batchv1.Job) bool {
+	namespace := repoConfig.EnvVarsMap.GetNameSpace()
+	for _, hook := range jobs {
+		job := hook.DeepCopy()
+		job.Name = fmt.Sprintf("%.40s-%d", hook.Name, time.Now().Unix())
+		if job.Labels == nil {
+			job.Labels = map[string]string{}
+		}
+		job.Labels[hookLabel] = hook.Name
+		job.Labels[releaseLabel] = repoConfig.ReleaseName
+		if job.Spec.ActiveDeadlineSeconds == nil {
+			job.Spec.ActiveDeadlineSeconds = &hookRunDeadline
+		}
+
+		fmt.Printf("\n=> Running the %s hook %s.\n", phase, hook.Name)
+		succeeded, err := kubeapi.RunJob(namespace, job, hook.Name)
+		if err != nil {
+			fmt.Printf("=> Oh no, %s\n", err)
+		}
+		kubeCleanUpHookRuns(hook.Name)
+		if !succeeded {
+			fmt.Printf("=> Oh no, the %s hook %s failed. The job %s is left in place, so you can look into it.\n", phase, hook.Name, job.Name)
+			return false
+		}
+		fmt.Printf("=> The %s hook %s succeeded.\n", phase, hook.Name)
+	}
+	return true
+}
+
+// kubeCleanUpHookRuns deletes the finished runs of the hook Job, apart from the most recent ones
+func kubeCleanUpHookRuns(name string) {
+	namespace := repoConfig.EnvVarsMap.GetNameSpace()
+	runs, err := kubeapi.ListJobs(namespace, map[string]string{hookLabel: name})
+	if err != nil {
+		fmt.Printf("=> Heads up: couldn't list the earlier runs of the hook %s to clean up: %s\n", name, err)
+		return
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].CreationTimestamp.Time.After(runs[j].CreationTimestamp.Time)
+	})
+
+	finished := 0
+	for i := range runs {
+		if !kubeapi.JobFinished(&runs[i]) {
+			continue
+		}
+		if finished++; finished > repoConfig.Rollout.HookRunsToKeep {
+			fmt.Printf("=> Cleaning up the old hook job %s.\n", runs[i].Name)
+			kubeapi.DeleteJob(namespace, runs[i].Name)
+		}
+	}
+}
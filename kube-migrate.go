@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+)
+
+var (
+	documentSeparator = regexp.MustCompile(`^---`)
+	apiVersionLine    = regexp.MustCompile(`^apiVersion:\s*["']?([^"'\s]+)["']?`)
+	kindLine          = regexp.MustCompile(`^kind:\s*["']?([^"'\s]+)["']?`)
+	selectorLine      = regexp.MustCompile(`^\s+selector:`)
+)
+
+// kubeMigrateManifests rewrites the apiVersion of the objects in the Kubernetes files (the templates themselves,
+// not the templated output) to the current group version, wherever only the apiVersion has to change.
+// The rest of the files, template expressions included, is left exactly as it is.
+func kubeMigrateManifests() {
+	dryRun := runFlags.Bool("dry-run")
+	templateFiles, err := ioutil.ReadDir(repoConfig.Application.PathToKubernetesFiles)
+	if err != nil {
+		log.Fatal("=> Unable to get list of kubernetes files.")
+	}
+
+	migrated, needsHand := 0, 0
+	for _, fileInfo := range templateFiles {
+		path := filepath.Join(repoConfig.Application.PathToKubernetesFiles, fileInfo.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("=> Uh oh, couldn't read %s: %s", path, err)
+		}
+
+		lines := strings.Split(string(content), "\n")
+		changed := false
+		for _, document := range splitDocuments(lines) {
+			versionIndex, groupVersion, kind := -1, "", ""
+			hasSelector := false
+			for _, i := range document {
+				if match := apiVersionLine.FindStringSubmatch(lines[i]); match != nil && versionIndex < 0 {
+					versionIndex, groupVersion = i, match[1]
+				} else if match := kindLine.FindStringSubmatch(lines[i]); match != nil && kind == "" {
+					kind = match[1]
+				} else if selectorLine.MatchString(lines[i]) {
+					hasSelector = true
+				}
+			}
+			if versionIndex < 0 || strings.Contains(groupVersion, "{{") {
+				continue
+			}
+
+			target, removal := kubeapi.MigrationTarget(groupVersion, kind)
+			// apps/v1 no longer defaults the selector to the pod template's labels
+			if target == "apps/v1" && groupVersion != target && !hasSelector {
+				fmt.Printf("=> %s: %s %s -> %s needs a 'spec.selector' first, so change it by hand.\n", fileInfo.Name(), kind, groupVersion, target)
+				needsHand++
+				continue
+			}
+			if target != groupVersion {
+				fmt.Printf("=> %s: %s %s -> %s\n", fileInfo.Name(), kind, groupVersion, target)
+				lines[versionIndex] = strings.Replace(lines[versionIndex], groupVersion, target, 1)
+				changed = true
+				migrated++
+			}
+			if removal != nil && removal.Replacement != "" {
+				fmt.Printf("=> %s: %s %s -> %s needs changing by hand: %s.\n", fileInfo.Name(), kind, target, removal.Replacement, removal.Note)
+				needsHand++
+			} else if removal != nil {
+				fmt.Printf("=> %s: %s %s needs changing by hand: %s.\n", fileInfo.Name(), kind, target, removal.Note)
+				needsHand++
+			}
+		}
+
+		if changed && !dryRun {
+			if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), fileInfo.Mode()); err != nil {
+				log.Fatalf("=> Uh oh, couldn't write %s: %s", path, err)
+			}
+		}
+	}
+
+	switch {
+	case migrated == 0 && needsHand == 0:
+		fmt.Println("=> All the apiVersions are up to date.")
+	case dryRun:
+		fmt.Printf("=> This was a dry run: %d object(s) would be migrated, and %d need changing by hand.\n", migrated, needsHand)
+	default:
+		fmt.Printf("=> Migrated %d object(s), and %d need changing by hand. Check the changes with 'git diff' before you roll out.\n", migrated, needsHand)
+	}
+	if needsHand > 0 {
+		os.Exit(1)
+	}
+}
+
+// splitDocuments groups the line numbers of a YAML file by document
+func splitDocuments(lines []string) [][]int {
+	documents := [][]int{{}}
+	for i, line := range lines {
+		if documentSeparator.MatchString(line) {
+			documents = append(documents, []int{})
+			continue
+		}
+		documents[len(documents)-1] = append(documents[len(documents)-1], i)
+	}
+	return documents
+}
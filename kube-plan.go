@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+// planTarget : what a rollout plan needs from the workload it rolls out
+type planTarget interface {
+	// desiredReplicas is the size of the new release in the Kubernetes files, which the plan always ends at
+	desiredReplicas() int32
+	// previousReplicas is the size of the previous release when the rollout started (0 if there is none)
+	previousReplicas() int32
+	previousRelease() string
+	// scaleNewRelease scales the new release and waits for its pods. Returns false if they didn't come up.
+	scaleNewRelease(replicas int32) bool
+	// routeTraffic sends a percentage of the traffic (or only the requests with the canary header) to the new release
+	routeTraffic(weight int, headerOnly bool) bool
+	// scaleDownPrevious sends all of the traffic to the new release, and scales the previous release down to 0
+	scaleDownPrevious() bool
+	bailOut()
+}
+
+// rolloutState : where a rollout plan is
+type rolloutState int
+
+const (
+	stateScaling rolloutState = iota
+	stateHolding
+	stateNextStep
+	stateFinishing
+	stateDone
+	stateFailed
+)
+
+// rolloutPlan : a state machine which takes a workload through the steps of the plan, one canary point at a time
+type rolloutPlan struct {
+	steps             []config.RolloutStep
+	target            planTarget
+	skipCanary        bool
+	state             rolloutState
+	step              int
+	replicas          int32 // the current size of the new release
+	weight            int   // the current percentage of the traffic going to the new release
+	headerOnly        bool
+	previousScaledOff bool
+}
+
+// defaultRolloutSteps is the classic kube-deploy rollout: one pod, all of the desired pods, and then scaling down
+// the previous release - with a canary point after each of them
+func defaultRolloutSteps(desiredReplicas int32) []config.RolloutStep {
+	analysed := repoConfig.Rollout.Analysis.Enabled()
+	firstCanaryPods := int32(1)
+	steps := []config.RolloutStep{
+		{Replicas: &firstCanaryPods, PauseSeconds: 60, Analysis: analysed, Approval: !analysed},
+		{Replicas: &desiredReplicas, PauseSeconds: 300, Analysis: analysed, Approval: !analysed},
+		{ScaleDownPrevious: true, PauseSeconds: 300, Analysis: analysed, Approval: !analysed},
+	}
+	// With a traffic router, the share of the traffic doesn't depend on the number of pods
+	if repoConfig.Rollout.Traffic.Router != "" {
+		firstWeight, secondWeight := 10, 50
+		steps[0].Weight, steps[1].Weight = &firstWeight, &secondWeight
+	}
+	return steps
+}
+
+// runRolloutPlan runs the steps of the 'rollout.steps' in the deploy.yaml (or the classic steps) against the target,
+// and bails out if any of them fail
+func runRolloutPlan(target planTarget, skipCanary bool) {
+	steps := repoConfig.Rollout.Steps
+	if len(steps) == 0 {
+		steps = defaultRolloutSteps(target.desiredReplicas())
+	}
+	// The size of the new release isn't known until the first step, since applying the files already scaled it
+	plan := &rolloutPlan{steps: steps, target: target, skipCanary: skipCanary, replicas: -1}
+	plan.run()
+}
+
+func (p *rolloutPlan) run() {
+	for p.state != stateDone {
+		switch p.state {
+		case stateScaling:
+			p.state = p.scale()
+		case stateHolding:
+			p.state = p.hold()
+		case stateNextStep:
+			p.step++
+			p.state = stateScaling
+			if p.step >= len(p.steps) {
+				p.state = stateFinishing
+			}
+		case stateFinishing:
+			p.state = p.finish()
+		case stateFailed:
+			p.target.bailOut()
+			return
+		}
+	}
+}
+
+// stepReplicas works out the size of the new release for the current step
+func (p *rolloutPlan) stepReplicas() int32 {
+	step := p.steps[p.step]
+	switch {
+	case step.Replicas != nil:
+		return *step.Replicas
+	case step.Percent != nil:
+		base := p.target.previousReplicas()
+		if base == 0 {
+			base = p.target.desiredReplicas()
+		}
+		replicas := (base*int32(*step.Percent) + 99) / 100
+		if replicas < 1 {
+			replicas = 1
+		}
+		return replicas
+	case p.replicas < 0:
+		// A first step without a size still has to wait for the pods of the new release (and check their digest)
+		// before it sends them traffic or scales down the previous release
+		return p.target.desiredReplicas()
+	default:
+		return p.replicas
+	}
+}
+
+func (p *rolloutPlan) scale() rolloutState {
+	step := p.steps[p.step]
+	replicas := p.stepReplicas()
+	weight, headerOnly := p.weight, p.headerOnly
+	if step.Weight != nil || step.HeaderOnly {
+		weight, headerOnly = 0, step.HeaderOnly
+		if step.Weight != nil {
+			weight = *step.Weight
+		}
+	}
+	route := (weight != p.weight || headerOnly != p.headerOnly) && !p.previousScaledOff
+	scaleDown := step.ScaleDownPrevious && !p.previousScaledOff && p.target.previousRelease() != ""
+	// A step which wouldn't change anything has nothing to hold for either
+	if replicas == p.replicas && !route && !scaleDown {
+		return stateNextStep
+	}
+
+	fmt.Printf("\n=> Step %d of %d.\n", p.step+1, len(p.steps))
+	if replicas != p.replicas {
+		fmt.Printf("=> Scaling the new release to %d pod(s).\n", replicas)
+		if !p.target.scaleNewRelease(replicas) {
+			return stateFailed
+		}
+		p.replicas = replicas
+	}
+	if route {
+		if !p.target.routeTraffic(weight, headerOnly) {
+			return stateFailed
+		}
+		p.weight, p.headerOnly = weight, headerOnly
+	}
+	if scaleDown {
+		fmt.Println("=> Scaling down the previous release, leaving only the pods of the new release.")
+		if !p.target.scaleDownPrevious() {
+			return stateFailed
+		}
+		p.previousScaledOff = true
+	}
+	return stateHolding
+}
+
+func (p *rolloutPlan) hold() rolloutState {
+	step := p.steps[p.step]
+	if p.skipCanary {
+		return stateNextStep
+	}
+
+	if step.Analysis && !canaryAnalysis(step.PauseSeconds, repoConfig.ReleaseName, p.target.previousRelease()) {
+		return stateFailed
+	}
+	switch {
+	case step.Approval && step.Analysis:
+		// The pause was spent on the analysis already
+		if !canaryApproval(0) {
+			return stateFailed
+		}
+	case step.Approval:
+		fmt.Printf("\n=> Wait for at least %d seconds, watch the monitors, and make sure everything looks good.\n", step.PauseSeconds)
+		if !canaryApproval(step.PauseSeconds) {
+			return stateFailed
+		}
+	case !step.Analysis && step.PauseSeconds > 0:
+		fmt.Printf("=> Pausing for %d seconds.\n", step.PauseSeconds)
+		time.Sleep(time.Duration(step.PauseSeconds) * time.Second)
+	}
+	return stateNextStep
+}
+
+// finish brings the new release to its desired size and scales down the previous release, if no step did
+func (p *rolloutPlan) finish() rolloutState {
+	if desired := p.target.desiredReplicas(); p.replicas != desired {
+		fmt.Printf("\n=> The plan is done, so scaling the new release to its desired %d pod(s).\n", desired)
+		if !p.target.scaleNewRelease(desired) {
+			return stateFailed
+		}
+		p.replicas = desired
+	}
+	if !p.previousScaledOff && p.target.previousRelease() != "" {
+		fmt.Println("\n=> The plan is done, so scaling down the previous release.")
+		if !p.target.scaleDownPrevious() {
+			return stateFailed
+		}
+		p.previousScaledOff = true
+	}
+	return stateDone
+}
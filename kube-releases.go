@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// releaseManifestsLabel marks the ConfigMaps which store the Kubernetes files of a release
+	releaseManifestsLabel = "kubedeploy-manifests"
+	releaseManifestsKey   = "objects.json.gz"
+	releaseNameAnnotation = "kubedeploy-release"
+	gitSHAAnnotation      = "kubedeploy-git-sha"
+)
+
+// releaseManifestsToKeep is how many releases can be restored from their Kubernetes files, once their Deployments
+// are cleaned up
+var releaseManifestsToKeep = 10
+
+// release : a release which can be rolled back to - because its Deployment is still there, or its Kubernetes files
+type release struct {
+	name       string
+	gitSHA     string
+	created    time.Time
+	deployment *appsv1.Deployment // nil if it was cleaned up
+	manifests  *corev1.ConfigMap  // nil if the Kubernetes files weren't stored
+}
+
+// kubeListReleases returns the releases of the app, the most recent first
+func kubeListReleases() []*release {
+	app := repoConfig.Application.Name + "-" + repoConfig.GitBranch
+	releases := map[string]*release{}
+
+	deployments := kubeapi.ListDeployments(map[string]string{"app": app})
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		releases[deployment.Name] = &release{name: deployment.Name, created: deployment.CreationTimestamp.Time, deployment: deployment}
+	}
+	configMaps, err := kubeapi.ListConfigMaps(map[string]string{"app": app, releaseManifestsLabel: "true"})
+	if err != nil {
+		fmt.Printf("=> Heads up: couldn't list the stored Kubernetes files of the releases: %s\n", err)
+	}
+	for i := range configMaps {
+		configMap := &configMaps[i]
+		name := configMap.Annotations[releaseNameAnnotation]
+		if releases[name] == nil {
+			releases[name] = &release{name: name, created: configMap.CreationTimestamp.Time}
+		}
+		releases[name].manifests = configMap
+		releases[name].gitSHA = configMap.Annotations[gitSHAAnnotation]
+	}
+
+	var sorted []*release
+	for _, r := range releases {
+		if r.gitSHA == "" {
+			r.gitSHA = releaseGitSHA(r.name)
+		}
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].created.After(sorted[j].created)
+	})
+	return sorted
+}
+
+// releaseGitSHA returns the short git SHA which the release name ends with
+func releaseGitSHA(name string) string {
+	return name[strings.LastIndex(name, "-")+1:]
+}
+
+// findRelease finds the release by its name, its git SHA, or how many releases back from the live release it is
+func findRelease(releases []*release, live string, ref string) (*release, error) {
+	for _, r := range releases {
+		if r.name == ref {
+			return r, nil
+		}
+	}
+
+	// Short git SHAs have at least 7 characters, so anything shorter is a number of releases
+	if back, err := strconv.Atoi(ref); err == nil && len(ref) < 7 {
+		liveIndex := -1
+		for i, r := range releases {
+			if r.name == live {
+				liveIndex = i
+			}
+		}
+		if liveIndex == -1 {
+			return nil, fmt.Errorf("there's no live release to count back from")
+		}
+		if back < 1 || liveIndex+back >= len(releases) {
+			return nil, fmt.Errorf("there are only %d releases before the live one", len(releases)-liveIndex-1)
+		}
+		return releases[liveIndex+back], nil
+	}
+
+	var found []*release
+	for _, r := range releases {
+		if len(ref) >= 7 && (strings.HasPrefix(r.gitSHA, ref) || strings.HasPrefix(ref, r.gitSHA)) {
+			found = append(found, r)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("there's no release %s to roll back to", ref)
+	}
+	// The same commit can be released more than once (eg. with another version), so take the most recent
+	return found[0], nil
+}
+
+// kubeStoreReleaseManifests stores the Kubernetes files of the release in a ConfigMap, so that the release can be
+// restored after its Deployment was cleaned up
+func kubeStoreReleaseManifests(objects []*unstructured.Unstructured) error {
+	var contents []map[string]interface{}
+	for _, object := range objects {
+		contents = append(contents, object.Object)
+	}
+	objectsJSON, err := json.Marshal(contents)
+	if err != nil {
+		return err
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(objectsJSON); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%.240s-manifests", repoConfig.ReleaseName)
+	configMap := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name": name,
+			"labels": map[string]interface{}{
+				"app":                 repoConfig.Application.Name + "-" + repoConfig.GitBranch,
+				releaseManifestsLabel: "true",
+			},
+			"annotations": map[string]interface{}{
+				releaseNameAnnotation: repoConfig.ReleaseName,
+				gitSHAAnnotation:      repoConfig.GitSHA,
+			},
+		},
+		"binaryData": map[string]interface{}{
+			releaseManifestsKey: base64.StdEncoding.EncodeToString(compressed.Bytes()),
+		},
+	}}
+	if _, err := kubeapi.ApplyObjects([]*unstructured.Unstructured{configMap}); err != nil {
+		return err
+	}
+	fmt.Printf("=> Stored the Kubernetes files of the release in the ConfigMap %s.\n", name)
+	return nil
+}
+
+// decodeReleaseManifests returns the objects from the Kubernetes files stored for a release
+func decodeReleaseManifests(configMap *corev1.ConfigMap) ([]*unstructured.Unstructured, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(configMap.BinaryData[releaseManifestsKey]))
+	if err != nil {
+		return nil, fmt.Errorf("the Kubernetes files in the ConfigMap %s can't be read: %s", configMap.Name, err)
+	}
+	objectsJSON, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("the Kubernetes files in the ConfigMap %s can't be read: %s", configMap.Name, err)
+	}
+	var contents []map[string]interface{}
+	if err := json.Unmarshal(objectsJSON, &contents); err != nil {
+		return nil, fmt.Errorf("the Kubernetes files in the ConfigMap %s can't be read: %s", configMap.Name, err)
+	}
+	var objects []*unstructured.Unstructured
+	for _, content := range contents {
+		objects = append(objects, &unstructured.Unstructured{Object: content})
+	}
+	return objects, nil
+}
+
+// kubePruneReleaseManifests deletes the stored Kubernetes files of the releases beyond the most recent ones,
+// unless their Deployments are still there
+func kubePruneReleaseManifests() {
+	stored := 0
+	for _, r := range kubeListReleases() {
+		if r.manifests == nil {
+			continue
+		}
+		if stored++; stored > releaseManifestsToKeep && r.deployment == nil {
+			fmt.Printf("=> Cleaning up the stored Kubernetes files of release %s.\n", r.name)
+			if err := kubeapi.DeleteConfigMap(r.manifests.Name); err != nil {
+				fmt.Printf("=> Heads up: %s\n", err)
+			}
+		}
+	}
+}
+
+// kubeRollbackTo rolls back to any release which is still there, or whose Kubernetes files are still stored. It goes
+// through the canary points like a rollout, with the release being rolled back to as the new release.
+func kubeRollbackTo(ref string) {
+	if _, ok := kubeCurrentWorkload().(*deploymentWorkload); !ok {
+		fmt.Println("=> Sorry, 'rollback --to' only works for Deployments. Use 'rollback' on its own to swap back to the previous revision.")
+		os.Exit(1)
+	}
+	// Switching the Service of a blue-green rollout has no canary points
+	if !repoConfig.Rollout.IsBlueGreen() && !kubeCanaryPromptsAnswerable() {
+		os.Exit(1)
+	}
+	// Like a rollout, it's only recorded in the history once it has the lock
+	cli.LockBeforeRollout(repoConfig.Application.Name, runFlags.Bool("force"))
+	historyStart("rollback", "--to "+ref)
+
+	releases := kubeListReleases()
+	var live *release
+	for _, r := range releases {
+		if r.deployment != nil && r.deployment.Labels["kubedeploy-is-live"] == "true" {
+			live = r
+			break
+		}
+	}
+	liveName := ""
+	if live != nil {
+		liveName = live.name
+	}
+	target, err := findRelease(releases, liveName, ref)
+	if err != nil {
+		fmt.Printf("=> Uh oh, %s.\n", err)
+		kubeBailOutAndExit()
+	}
+	if target.name == liveName {
+		fmt.Printf("=> %s is already live, so there's nothing to roll back.\n", target.name)
+		historySetRelease(target.name, target.gitSHA)
+		historyFinish("skipped")
+		cli.UnlockAfterRollout(repoConfig.Application.Name)
+		return
+	}
+
+	var objects []*unstructured.Unstructured
+	if target.manifests != nil {
+		if objects, err = decodeReleaseManifests(target.manifests); err != nil {
+			fmt.Printf("=> Uh oh, %s\n", err)
+			kubeBailOutAndExit()
+		}
+	}
+	var workloadObject *unstructured.Unstructured
+	if target.deployment == nil {
+		if workloadObject = findObject(objects, "Deployment", target.name); workloadObject == nil {
+			fmt.Printf("=> Uh oh, the stored Kubernetes files of %s don't have its Deployment.\n", target.name)
+			kubeBailOutAndExit()
+		}
+		// The canary points scale it up from nothing
+		unstructured.SetNestedField(workloadObject.Object, int64(0), "spec", "replicas")
+	}
+
+	fmt.Printf("=> Rolling back to %s (git SHA %s).\n", target.name, target.gitSHA)
+	historySetRelease(target.name, target.gitSHA)
+	repoConfig.ReleaseName = target.name
+	skipCanary := runFlags.Bool("no-canary") || runFlags.Bool("force")
+
+	if repoConfig.Rollout.IsBlueGreen() {
+		// Switching the Service is instant, like a plain 'rollback'
+		if live == nil {
+			fmt.Println("=> Uh oh, there's no live release with a Service to switch back from.")
+			kubeBailOutAndExit()
+		}
+		if target.deployment == nil {
+			if err := kubeRestoreRelease(objects, workloadObject, repoConfig.Rollout.BlueGreen.Service); err != nil {
+				fmt.Printf("=> Uh oh, %s\n", err)
+				kubeBailOutAndExit()
+			}
+			target.deployment = kubeapi.GetSingleDeployment(target.name)
+		}
+		if !kubeBlueGreenRollback(*live.deployment, *target.deployment) {
+			kubeBailOutAndExit()
+		}
+		kubeRelabelReleases(target.name, liveName)
+		cli.UnlockAfterRollout(repoConfig.Application.Name)
+	} else {
+		w := &deploymentWorkload{objects: objects, manifests: deepCopyObjects(objects), rollbackTo: true, digestVerified: true}
+		if live != nil && live.deployment.Spec.Replicas != nil && *live.deployment.Spec.Replicas > 0 {
+			w.desiredPods = *live.deployment.Spec.Replicas
+		} else {
+			w.desiredPods = 1
+		}
+		if target.deployment != nil && target.deployment.Spec.Template.Labels[releaseLabel] == "" {
+			// Without the label, the stable and canary Services can't tell the pods apart
+			w.objects = nil
+		}
+		w.prepare(workloadObject, skipCanary)
+		if target.deployment == nil {
+			if err := kubeRestoreRelease(objects, nil, ""); err != nil {
+				fmt.Printf("=> Uh oh, %s\n", err)
+				kubeBailOutAndExit()
+			}
+		}
+		w.rollout(skipCanary)
+		kubeRelabelReleases(target.name, w.mostRecentRelease.Name)
+		cli.UnlockAfterRollout(repoConfig.Application.Name)
+		fmt.Printf("=> The deployment has been successfully rolled back to: %s.\n", target.name)
+	}
+}
+
+// kubeRestoreRelease applies the stored Kubernetes files of a release whose Deployment was cleaned up - apart from
+// the Service which a blue-green rollback switches by itself
+func kubeRestoreRelease(objects []*unstructured.Unstructured, workloadObject *unstructured.Unstructured, skipService string) error {
+	var restored []*unstructured.Unstructured
+	for _, object := range objects {
+		if object.GetKind() != "Service" || object.GetName() != skipService {
+			restored = append(restored, object)
+		}
+	}
+	if workloadObject != nil {
+		unstructured.SetNestedField(workloadObject.Object, repoConfig.ReleaseName, "spec", "template", "metadata", "labels", releaseLabel)
+	}
+
+	fmt.Println("=> Restoring the release from its stored Kubernetes files.")
+	results, err := kubeapi.ApplyObjects(restored)
+	for _, result := range results {
+		fmt.Printf("=> %s\n", result)
+	}
+	if err != nil {
+		return fmt.Errorf("there was a problem applying the stored Kubernetes files: %s", err)
+	}
+	return nil
+}
+
+// kubeRelabelReleases makes sure that only the live release is labelled 'kubedeploy-is-live', and only the release
+// before it 'kubedeploy-rollback-target'
+func kubeRelabelReleases(live string, rollbackTarget string) {
+	deployments := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch})
+	for _, d := range deployments.Items {
+		isLive := d.Labels["kubedeploy-is-live"] == "true"
+		isRollbackTarget := d.Labels["kubedeploy-rollback-target"] == "true"
+		if isLive == (d.Name == live) && isRollbackTarget == (d.Name == rollbackTarget && rollbackTarget != "") {
+			continue
+		}
+		kubeapi.UpdateDeployment(d.Name, func(deployment *appsv1.Deployment) {
+			if len(deployment.ObjectMeta.Labels) == 0 {
+				deployment.ObjectMeta.Labels = make(map[string]string, 1)
+			}
+			delete(deployment.ObjectMeta.Labels, "kubedeploy-is-live")
+			delete(deployment.ObjectMeta.Labels, "kubedeploy-rollback-target")
+			if deployment.Name == live {
+				deployment.ObjectMeta.Labels["kubedeploy-is-live"] = "true"
+			} else if deployment.Name == rollbackTarget {
+				deployment.ObjectMeta.Labels["kubedeploy-rollback-target"] = "true"
+			}
+		})
+	}
+}
+
+func deepCopyObjects(objects []*unstructured.Unstructured) []*unstructured.Unstructured {
+	var copies []*unstructured.Unstructured
+	for _, object := range objects {
+		copies = append(copies, object.DeepCopy())
+	}
+	return copies
+}
+
+// kubeLabelReleaseObjects labels the ConfigMaps and Secrets which are specific to the release (the ones with the
+// release name in their names) with the release, so that they're cleaned up along with it
+func kubeLabelReleaseObjects(objects []*unstructured.Unstructured) {
+	for _, object := range objects {
+		kind := object.GetKind()
+		if (kind != "ConfigMap" && kind != "Secret") || !strings.Contains(object.GetName(), repoConfig.ReleaseName) {
+			continue
+		}
+		labels := object.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[releaseLabel] = repoConfig.ReleaseName
+		object.SetLabels(labels)
+	}
+}
+
+// kubeCleanUpReleases deletes the releases beyond the 'rollout.keepReleases' most recent ones which are scaled down
+// to 0, along with their ConfigMaps and Secrets. The current and previous releases always stay, and so does any
+// release which still has pods.
+func kubeCleanUpReleases(current string, previous string) {
+	deployments := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch})
+	sort.Slice(deployments.Items, func(i, j int) bool {
+		return deployments.Items[i].CreationTimestamp.Time.After(deployments.Items[j].CreationTimestamp.Time)
+	})
+
+	kept := 0
+	for i := range deployments.Items {
+		d := &deployments.Items[i]
+		if d.Name == current {
+			continue
+		}
+		if (d.Spec.Replicas != nil && *d.Spec.Replicas > 0) || d.Status.Replicas > 0 {
+			if d.Name != previous {
+				fmt.Printf("=> Leaving the older deployment %s in place, since it still has pods.\n", d.Name)
+			}
+			continue
+		}
+		if kept < repoConfig.Rollout.KeepReleases || d.Name == previous {
+			kept++
+			continue
+		}
+
+		fmt.Printf("=> Cleaning up older deployment: %s.\n", d.Name)
+		kubeapi.DeleteDeployment(d)
+		deleted, err := kubeapi.DeleteConfigMapsAndSecrets(map[string]string{releaseLabel: d.Name})
+		for _, object := range deleted {
+			fmt.Printf("=> Cleaning up %s of release %s.\n", object, d.Name)
+		}
+		if err != nil {
+			fmt.Printf("=> Heads up: couldn't clean up the ConfigMaps and Secrets of release %s: %s\n", d.Name, err)
+		}
+	}
+}
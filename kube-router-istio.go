@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// istioRouter : splits the traffic with weighted destinations in the app's VirtualService, between the stable
+// and the canary Service
+type istioRouter struct {
+	services *releaseServices
+	original *unstructured.Unstructured // the VirtualService as it was templated
+}
+
+func (r *istioRouter) prepare(objects []*unstructured.Unstructured) error {
+	if err := r.services.prepare(objects); err != nil {
+		return err
+	}
+	name := repoConfig.Rollout.Traffic.VirtualService
+	virtualService := findObject(objects, "VirtualService", name)
+	if virtualService == nil {
+		return fmt.Errorf("the Kubernetes files have no VirtualService %s to route the traffic with", name)
+	}
+	r.original = virtualService.DeepCopy()
+	if _, err := r.split(0, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *istioRouter) start() error {
+	if err := r.services.start(); err != nil {
+		return err
+	}
+	return r.setWeight(0, false)
+}
+
+func (r *istioRouter) setWeight(weight int, headerOnly bool) error {
+	virtualService, err := r.split(weight, headerOnly)
+	if err != nil {
+		return err
+	}
+	return kubeApplyRouting(virtualService)
+}
+
+func (r *istioRouter) promote() error {
+	if err := r.services.promote(); err != nil {
+		return err
+	}
+	if err := kubeApplyRouting(r.original.DeepCopy()); err != nil {
+		return err
+	}
+	return r.services.remove()
+}
+
+func (r *istioRouter) promoted() bool { return r.services.promoted }
+
+func (r *istioRouter) abort() error {
+	if err := r.services.demote(); err != nil {
+		return err
+	}
+	if err := kubeApplyRouting(r.original.DeepCopy()); err != nil {
+		return err
+	}
+	return r.services.remove()
+}
+
+// split returns the VirtualService with every HTTP route to the stable Service split between the stable and the
+// canary Service. With headerOnly, the weight is 0, and requests with the canary header get a route of their own
+// to the canary Service.
+func (r *istioRouter) split(weight int, headerOnly bool) (*unstructured.Unstructured, error) {
+	if headerOnly {
+		weight = 0
+	}
+	virtualService := r.original.DeepCopy()
+	stableName, canaryName := r.services.stable.GetName(), r.services.canary.GetName()
+	traffic := repoConfig.Rollout.Traffic
+
+	httpRoutes, _, _ := unstructured.NestedSlice(virtualService.Object, "spec", "http")
+	var splitRoutes []interface{}
+	found := false
+	for _, httpRoute := range httpRoutes {
+		route, ok := httpRoute.(map[string]interface{})
+		destinations, _ := route["route"].([]interface{})
+		if !ok || len(destinations) != 1 {
+			splitRoutes = append(splitRoutes, httpRoute)
+			continue
+		}
+		first, _ := destinations[0].(map[string]interface{})
+		stable, _ := first["destination"].(map[string]interface{})
+		host, _ := stable["host"].(string)
+		if host != stableName && !strings.HasPrefix(host, stableName+".") {
+			splitRoutes = append(splitRoutes, httpRoute)
+			continue
+		}
+		found = true
+
+		// The same destination (port and all), with the canary Service's host
+		canary := runtime.DeepCopyJSONValue(stable).(map[string]interface{})
+		canary["host"] = canaryName + strings.TrimPrefix(host, stableName)
+
+		if headerOnly {
+			headerRoute := runtime.DeepCopyJSONValue(route).(map[string]interface{})
+			if name, ok := headerRoute["name"].(string); ok {
+				headerRoute["name"] = name + "-canary"
+			}
+			matches, _ := headerRoute["match"].([]interface{})
+			if len(matches) == 0 {
+				matches = []interface{}{map[string]interface{}{}}
+			}
+			// Every condition of the route also needs the header
+			for _, match := range matches {
+				if match, ok := match.(map[string]interface{}); ok {
+					headers, _ := match["headers"].(map[string]interface{})
+					if headers == nil {
+						headers = map[string]interface{}{}
+					}
+					headers[strings.ToLower(traffic.CanaryHeader)] = map[string]interface{}{"exact": traffic.CanaryHeaderValue}
+					match["headers"] = headers
+				}
+			}
+			headerRoute["match"] = matches
+			headerRoute["route"] = []interface{}{map[string]interface{}{"destination": canary}}
+			splitRoutes = append(splitRoutes, headerRoute)
+		}
+
+		route["route"] = []interface{}{
+			map[string]interface{}{"destination": stable, "weight": int64(100 - weight)},
+			map[string]interface{}{"destination": canary, "weight": int64(weight)},
+		}
+		splitRoutes = append(splitRoutes, route)
+	}
+
+	if !found {
+		return nil, fmt.Errorf("the VirtualService %s has no HTTP route with the Service %s as its only destination", r.original.GetName(), stableName)
+	}
+	unstructured.SetNestedSlice(virtualService.Object, splitRoutes, "spec", "http")
+	return virtualService, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const nginxAnnotationPrefix = "nginx.ingress.kubernetes.io/"
+
+// nginxRouter : splits the traffic with a canary Ingress, which the NGINX Ingress controller merges into the
+// app's Ingress - a copy of it with the 'canary-weight' and 'canary-by-header' annotations, routing to the
+// canary Service
+type nginxRouter struct {
+	services *releaseServices
+	canary   *unstructured.Unstructured
+}
+
+func (r *nginxRouter) prepare(objects []*unstructured.Unstructured) error {
+	if err := r.services.prepare(objects); err != nil {
+		return err
+	}
+	name := repoConfig.Rollout.Traffic.Ingress
+	ingress := findObject(objects, "Ingress", name)
+	if ingress == nil {
+		return fmt.Errorf("the Kubernetes files have no Ingress %s to make a canary Ingress from", name)
+	}
+
+	r.canary = ingress.DeepCopy()
+	r.canary.SetName(name + "-canary")
+	spec, _, _ := unstructured.NestedFieldNoCopy(r.canary.Object, "spec")
+	if !renameBackends(spec, r.services.stable.GetName(), r.services.canary.GetName()) {
+		return fmt.Errorf("the Ingress %s has no backend with the Service %s", name, r.services.stable.GetName())
+	}
+
+	annotations := r.canary.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[nginxAnnotationPrefix+"canary"] = "true"
+	annotations[nginxAnnotationPrefix+"canary-by-header"] = repoConfig.Rollout.Traffic.CanaryHeader
+	// NGINX routes on 'always' (and 'never') without a header value
+	if value := repoConfig.Rollout.Traffic.CanaryHeaderValue; value != "always" {
+		annotations[nginxAnnotationPrefix+"canary-by-header-value"] = value
+	}
+	r.canary.SetAnnotations(annotations)
+	return nil
+}
+
+func (r *nginxRouter) start() error {
+	if err := r.services.start(); err != nil {
+		return err
+	}
+	return r.setWeight(0, false)
+}
+
+func (r *nginxRouter) setWeight(weight int, headerOnly bool) error {
+	if headerOnly {
+		weight = 0
+	}
+	annotations := r.canary.GetAnnotations()
+	annotations[nginxAnnotationPrefix+"canary-weight"] = strconv.Itoa(weight)
+	r.canary.SetAnnotations(annotations)
+	return kubeApplyRouting(r.canary)
+}
+
+func (r *nginxRouter) promote() error {
+	if err := r.services.promote(); err != nil {
+		return err
+	}
+	if err := kubeDeleteRouting(r.canary); err != nil {
+		return err
+	}
+	return r.services.remove()
+}
+
+func (r *nginxRouter) promoted() bool { return r.services.promoted }
+
+func (r *nginxRouter) abort() error {
+	if err := r.services.demote(); err != nil {
+		return err
+	}
+	if err := kubeDeleteRouting(r.canary); err != nil {
+		return err
+	}
+	return r.services.remove()
+}
+
+// renameBackends points the backends of an Ingress spec with the Service 'from' to the Service 'to' - both the
+// 'serviceName' of the older Ingress versions and the 'service.name' of networking.k8s.io/v1.
+// Returns false if there was no such backend.
+func renameBackends(value interface{}, from string, to string) bool {
+	renamed := false
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if value["serviceName"] == from {
+			value["serviceName"] = to
+			renamed = true
+		}
+		if service, ok := value["service"].(map[string]interface{}); ok && service["name"] == from {
+			service["name"] = to
+			renamed = true
+		}
+		for key, field := range value {
+			if key != "service" {
+				renamed = renameBackends(field, from, to) || renamed
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			renamed = renameBackends(item, from, to) || renamed
+		}
+	}
+	return renamed
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// releaseLabel is the pod label with the release name, which the stable and canary Services select on
+const releaseLabel = "kubedeploy-release"
+
+// trafficRouter : splits the traffic between the previous release and the new one with exact weights,
+// whatever the number of pods of each release
+type trafficRouter interface {
+	// prepare changes the templated objects before they're applied (eg. to pin the Service to the previous release)
+	prepare(objects []*unstructured.Unstructured) error
+	// start creates the canary routing, with none of the traffic going to the new release yet
+	start() error
+	setWeight(weight int, headerOnly bool) error
+	// promote sends all of the traffic to the new release, and removes the canary routing
+	promote() error
+	// abort sends all of the traffic back to the previous release, and removes the canary routing - after promote
+	// too, by pointing the stable Service back at the pods of the previous release
+	abort() error
+	promoted() bool
+}
+
+// newTrafficRouter returns the router from the deploy.yaml, for a rollout from the previous release to this release
+func newTrafficRouter(previousRelease string) trafficRouter {
+	services := &releaseServices{previousRelease: previousRelease, newRelease: repoConfig.ReleaseName}
+	switch repoConfig.Rollout.Traffic.Router {
+	case "nginx":
+		return &nginxRouter{services: services}
+	case "istio":
+		return &istioRouter{services: services}
+	default:
+		return nil
+	}
+}
+
+// releaseServices : the app's Service, pinned to the pods of the previous release while the new release is the
+// canary (the stable Service) - plus a copy of it which selects the pods of the new release (the canary Service)
+type releaseServices struct {
+	previousRelease string
+	newRelease      string
+	stable          *unstructured.Unstructured
+	canary          *unstructured.Unstructured
+	promoted        bool // whether the stable Service selects the new release
+}
+
+func (s *releaseServices) prepare(objects []*unstructured.Unstructured) error {
+	name := repoConfig.Rollout.Traffic.Service
+	if s.stable = findObject(objects, "Service", name); s.stable == nil {
+		return fmt.Errorf("the Kubernetes files have no Service %s to split the traffic of", name)
+	}
+	unstructured.SetNestedField(s.stable.Object, s.previousRelease, "spec", "selector", releaseLabel)
+
+	// The canary Service is only reached through the router
+	s.canary = releaseServiceCopy(s.stable, name+"-canary", s.newRelease)
+	return nil
+}
+
+func (s *releaseServices) start() error {
+	return kubeApplyRouting(s.canary)
+}
+
+// promote points the stable Service at the pods of the new release
+func (s *releaseServices) promote() error {
+	unstructured.SetNestedField(s.stable.Object, s.newRelease, "spec", "selector", releaseLabel)
+	// Even if the apply failed, the Service may have been changed, so make sure to point it back
+	s.promoted = true
+	return kubeApplyRouting(s.stable)
+}
+
+// demote points the stable Service back at the pods of the previous release, if promote did point it at the new
+// release
+func (s *releaseServices) demote() error {
+	if !s.promoted {
+		return nil
+	}
+	unstructured.SetNestedField(s.stable.Object, s.previousRelease, "spec", "selector", releaseLabel)
+	if err := kubeApplyRouting(s.stable); err != nil {
+		return err
+	}
+	s.promoted = false
+	return nil
+}
+
+func (s *releaseServices) remove() error {
+	return kubeDeleteRouting(s.canary)
+}
+
+// releaseServiceCopy returns a copy of the Service with another name, which only selects the pods of the release.
+// It's an internal Service, so it gets no IP or node ports of its own.
+func releaseServiceCopy(service *unstructured.Unstructured, name string, release string) *unstructured.Unstructured {
+	serviceCopy := service.DeepCopy()
+	serviceCopy.SetName(name)
+	unstructured.SetNestedField(serviceCopy.Object, release, "spec", "selector", releaseLabel)
+	unstructured.SetNestedField(serviceCopy.Object, "ClusterIP", "spec", "type")
+	unstructured.RemoveNestedField(serviceCopy.Object, "spec", "clusterIP")
+	if ports, found, _ := unstructured.NestedSlice(serviceCopy.Object, "spec", "ports"); found {
+		for _, port := range ports {
+			if port, ok := port.(map[string]interface{}); ok {
+				delete(port, "nodePort")
+			}
+		}
+		unstructured.SetNestedSlice(serviceCopy.Object, ports, "spec", "ports")
+	}
+	return serviceCopy
+}
+
+// findObject returns the templated object with the kind and name (nil if there's none)
+func findObject(objects []*unstructured.Unstructured, kind string, name string) *unstructured.Unstructured {
+	for _, object := range objects {
+		if object.GetKind() == kind && object.GetName() == name {
+			return object
+		}
+	}
+	return nil
+}
+
+func kubeApplyRouting(objects ...*unstructured.Unstructured) error {
+	results, err := kubeapi.ApplyObjects(objects)
+	for _, result := range results {
+		fmt.Printf("=> %s\n", result)
+	}
+	return err
+}
+
+func kubeDeleteRouting(objects ...*unstructured.Unstructured) error {
+	results, errs := kubeapi.DeleteObjects(objects, false)
+	for _, result := range results {
+		fmt.Printf("=> %s\n", result)
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
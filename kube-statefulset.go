@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// statefulSetWorkload : rolls out a StatefulSet in place, with the pod with the highest ordinal as the canary
+// (the other pods are held back by the update partition until the canary looks good)
+type statefulSetWorkload struct {
+	name             string
+	existed          bool
+	previousRevision string // the revision the pods ran before this rollout
+	canaryPartition  int32  // the ordinal from which pods are updated first (0 if there's no canary)
+}
+
+func (w *statefulSetWorkload) prepare(object *unstructured.Unstructured, skipCanary bool) {
+	existing, err := kubeapi.GetStatefulSet(w.name)
+	if errors.IsNotFound(err) {
+		fmt.Printf("=> This is the first rollout of statefulset %s, so all of its pods start with this release.\n", w.name)
+		return
+	} else if err != nil {
+		log.Fatalf("=> Oh no, couldn't get statefulset %s: %s", w.name, err)
+	}
+	w.existed = true
+	w.previousRevision = existing.Status.UpdateRevision
+
+	replicas, found, _ := unstructured.NestedInt64(object.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
+	}
+	strategy, _, _ := unstructured.NestedString(object.Object, "spec", "updateStrategy", "type")
+	switch {
+	case skipCanary || replicas < 2:
+		return
+	case strategy == string(appsv1.OnDeleteStatefulSetStrategyType):
+		fmt.Println("=> Heads up: this statefulset uses the 'OnDelete' update strategy, so its pods only change when you delete them.")
+		return
+	}
+
+	// Hold back the update for every pod but the last one
+	w.canaryPartition = int32(replicas - 1)
+	unstructured.SetNestedField(object.Object, string(appsv1.RollingUpdateStatefulSetStrategyType), "spec", "updateStrategy", "type")
+	unstructured.SetNestedField(object.Object, int64(w.canaryPartition), "spec", "updateStrategy", "rollingUpdate", "partition")
+}
+
+func (w *statefulSetWorkload) rollout(skipCanary bool) {
+	if w.canaryPartition > 0 {
+		fmt.Printf("=> Updating the canary pod %s-%d first.\n", w.name, w.canaryPartition)
+		if !kubeapi.WaitForStatefulSetRollout(w.name).Complete {
+			w.bailOut()
+		}
+		fmt.Println("\n=> Wait for at least one minute to make sure the new pod started okay, and is getting some traffic.")
+		if y := canaryHoldAndWait(60, repoConfig.ReleaseName, ""); y == false {
+			w.bailOut()
+		}
+
+		fmt.Println("=> Updating the rest of the pods.")
+		kubeapi.UpdateStatefulSet(w.name, releasePartition)
+	}
+
+	if !kubeapi.WaitForStatefulSetRollout(w.name).Complete {
+		w.bailOut()
+	}
+	if w.existed && !skipCanary {
+		fmt.Println("\n=> Now, let's wait for 5 minutes, watch the monitors, and let everything simmer to make sure it looks good.")
+		if y := canaryHoldAndWait(300, repoConfig.ReleaseName, ""); y == false {
+			w.bailOut()
+		}
+	}
+}
+
+// bailOut puts the pods back on the revision they ran before the rollout
+func (w *statefulSetWorkload) bailOut() {
+	fmt.Println("=> Okay, let's try and bail out safely.")
+	current, err := kubeapi.GetStatefulSet(w.name)
+	switch {
+	case !w.existed:
+		fmt.Println("=> Oh no, I don't have anywhere to roll back to! I'll leave things as they are now, but you'll need to clean up yourself, or do another rollout forward.")
+	case err != nil:
+		fmt.Printf("=> Oh no, couldn't get statefulset %s: %s\n", w.name, err)
+	case current.Status.UpdateRevision == w.previousRevision:
+		fmt.Println("=> The pod template didn't change, so there's nothing to roll back.")
+	default:
+		if err := kubeapi.RollBackToRevision("StatefulSet", w.name, w.previousRevision); err != nil {
+			fmt.Printf("=> Oh no, rolling back failed: %s\n=> You'll need to clean up yourself.\n", err)
+			break
+		}
+		// Only release the partition once the template is back, or the remaining pods would get the new release
+		kubeapi.UpdateStatefulSet(w.name, releasePartition)
+		kubeapi.WaitForStatefulSetRollout(w.name)
+	}
+	kubeBailOutAndExit()
+}
+
+func (w *statefulSetWorkload) scale(replicas int32) {
+	fmt.Printf("=> Starting to scale to %d replica(s).\n", replicas)
+	kubeapi.UpdateStatefulSet(w.name, func(statefulSet *appsv1.StatefulSet) {
+		statefulSet.Spec.Replicas = &replicas
+	})
+	if !kubeapi.WaitForStatefulSetRollout(w.name).Complete {
+		exitWithHistory()
+	}
+	fmt.Printf("=> Finished scaling to %d replica(s).\n", replicas)
+}
+
+func (w *statefulSetWorkload) rollingRestart() {
+	kubeapi.UpdateStatefulSet(w.name, func(statefulSet *appsv1.StatefulSet) {
+		releasePartition(statefulSet)
+		if statefulSet.Spec.Template.ObjectMeta.Labels == nil {
+			statefulSet.Spec.Template.ObjectMeta.Labels = map[string]string{}
+		}
+		statefulSet.Spec.Template.ObjectMeta.Labels["kubedeploy-last-rolling-restart"] = strconv.FormatInt(time.Now().Unix(), 10)
+	})
+	if !kubeapi.WaitForStatefulSetRollout(w.name).Complete {
+		exitWithHistory()
+	}
+
+	fmt.Printf("\n=> All pods have been recreated.\n\n")
+}
+
+func (w *statefulSetWorkload) rollback() {
+	if !kubeCanaryPromptsAnswerable() {
+		exitWithHistory()
+	}
+	if err := kubeapi.RollBackToPreviousRevision("StatefulSet", w.name); err != nil {
+		fmt.Printf("=> Oh no, %s\n", err)
+		exitWithHistory()
+	}
+	kubeapi.UpdateStatefulSet(w.name, releasePartition)
+	if !kubeapi.WaitForStatefulSetRollout(w.name).Complete {
+		exitWithHistory()
+	}
+
+	if !runFlags.Bool("force") && !runFlags.Bool("no-canary") {
+		fmt.Println("\n=> Wait for one minute to make sure that the old pods came up correctly.")
+		canaryHoldAndWait(60, repoConfig.ReleaseName, "")
+	}
+	fmt.Printf("=> Statefulset %s has been successfully rolled back.\n", w.name)
+}
+
+// releasePartition lets the update through to all pods of the statefulset
+func releasePartition(statefulSet *appsv1.StatefulSet) {
+	if statefulSet.Spec.UpdateStrategy.RollingUpdate != nil {
+		statefulSet.Spec.UpdateStrategy.RollingUpdate.Partition = new(int32)
+	}
+}
@@ -11,27 +11,39 @@ import (
 
 // Returns a list of the filenames of the filled-out templates
 func kubeMakeTemplates() []string {
+	filePaths, err := kubeTryMakeTemplates()
+	if err != nil {
+		log.Fatalf("=> %s", err)
+	}
+	return filePaths
+}
+
+// kubeTryMakeTemplates fills out the templates like kubeMakeTemplates, but returns what went wrong instead of exiting
+func kubeTryMakeTemplates() ([]string, error) {
 	os.MkdirAll(repoConfig.PWD+"/.kubedeploy-temp", 0755)
 
 	templateFiles, err := ioutil.ReadDir(repoConfig.Application.PathToKubernetesFiles)
 	if err != nil {
-		log.Fatal("=> Unable to get list of kubernetes files.")
+		return nil, fmt.Errorf("Unable to get list of kubernetes files.")
 	}
 
 	var filePaths []string
 	for _, filePointer := range templateFiles {
 		filename := filePointer.Name()
 		fmt.Printf("=> Generating YAML from template for %s\n", filename)
-		kubeFileTemplated := runConsulTemplate(repoConfig.Application.PathToKubernetesFiles + "/" + filename)
+		kubeFileTemplated, err := runConsulTemplate(repoConfig.Application.PathToKubernetesFiles + "/" + filename)
+		if err != nil {
+			return nil, err
+		}
 
 		tempFilePath := repoConfig.PWD + "/.kubedeploy-temp/" + filename
-		err := ioutil.WriteFile(tempFilePath, []byte(kubeFileTemplated), 0644)
+		err = ioutil.WriteFile(tempFilePath, []byte(kubeFileTemplated), 0644)
 		if err != nil {
 			fmt.Println(err)
 		}
 		filePaths = append(filePaths, tempFilePath)
 	}
-	return filePaths
+	return filePaths, nil
 }
 
 func kubeRemoveTemplates() {
@@ -42,7 +54,7 @@ func kubeRemoveTemplates() {
 	}
 }
 
-func runConsulTemplate(filename string) string {
+func runConsulTemplate(filename string) (string, error) {
 	vaultAddr := os.Getenv("VAULT_ADDR")
 	if vaultAddr != "" {
 		vaultAddr = fmt.Sprintf("--vault-renew-token=false --vault-retry=false --vault-addr %s", vaultAddr)
@@ -69,8 +81,8 @@ func runConsulTemplate(filename string) string {
 
 	output, exitCode := cli.GetCommandOutputAndExitCode("consul-template", consulTemplateArgs)
 	if exitCode != 0 {
-		log.Fatal("=> Oh no, looks like consul-template failed!")
+		return "", fmt.Errorf("Oh no, looks like consul-template failed!")
 	}
 
-	return strings.Join(strings.Split(output, "\n")[1:], "\n")
+	return strings.Join(strings.Split(output, "\n")[1:], "\n"), nil
 }
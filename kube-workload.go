@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	kubeapi "github.com/mycujoo/kube-deploy/kube/api"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// workloadStrategy : how one kind of workload is rolled out, scaled, restarted and rolled back
+type workloadStrategy interface {
+	// prepare runs before the templated objects are applied, and can change the workload's object (eg. to hold back an update)
+	prepare(object *unstructured.Unstructured, skipCanary bool)
+	// rollout takes the applied workload through its canary points, and bails out if any of them fail
+	rollout(skipCanary bool)
+	scale(replicas int32)
+	rollingRestart()
+	rollback()
+}
+
+// kubeTemplatedObjects fills out the Kubernetes templates and decodes every object in them. It stops if the
+// cluster doesn't serve the apiVersion of any of the objects.
+func kubeTemplatedObjects() []*unstructured.Unstructured {
+	objects, err := kubeDecodeTemplates(kubeMakeTemplates())
+	if err != nil {
+		kubeRemoveTemplates()
+		log.Fatalf("=> Uh oh, %s", err)
+	}
+	if !kubeCheckAPIVersions(objects) {
+		kubeRemoveTemplates()
+		os.Exit(1)
+	}
+	return objects
+}
+
+// kubeDecodeTemplates decodes every object in the templated files
+func kubeDecodeTemplates(files []string) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+	for _, f := range files {
+		manifests, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the templated file %s: %s", f, err)
+		}
+		fileObjects, err := kubeapi.DecodeManifests(manifests)
+		if err != nil {
+			return nil, fmt.Errorf("there was a problem in the templated file %s: %s", f, err)
+		}
+		objects = append(objects, fileObjects...)
+	}
+	return objects, nil
+}
+
+// kubeCheckAPIVersions prints the objects with a deprecated apiVersion, or one the cluster doesn't serve.
+// Returns false if any object can't be applied because of it.
+func kubeCheckAPIVersions(objects []*unstructured.Unstructured) bool {
+	ok := true
+	for _, problem := range kubeapi.CheckAPIVersions(objects) {
+		if problem.Fatal {
+			ok = false
+			fmt.Printf("=> Uh oh, %s\n", problem)
+		} else {
+			fmt.Printf("=> Heads up: %s\n", problem)
+		}
+	}
+	return ok
+}
+
+// kubeWorkloadStrategy picks how to roll out from the templated objects: the Deployment named after the release
+// (the classic kube-deploy rollout), or else the only StatefulSet, DaemonSet or CronJob
+func kubeWorkloadStrategy(objects []*unstructured.Unstructured) (workloadStrategy, *unstructured.Unstructured) {
+	var candidates []*unstructured.Unstructured
+	for _, object := range objects {
+		switch object.GetKind() {
+		case "Deployment":
+			if object.GetName() == repoConfig.ReleaseName {
+				return &deploymentWorkload{objects: objects, manifests: deepCopyObjects(objects)}, object
+			}
+		case "StatefulSet", "DaemonSet", "CronJob":
+			candidates = append(candidates, object)
+		}
+	}
+
+	if len(candidates) != 1 {
+		fmt.Printf("=> Uh oh, I don't know what to roll out. The Kubernetes files need a Deployment named %s (the release name), or exactly one StatefulSet, DaemonSet or CronJob.\n", repoConfig.ReleaseName)
+		for _, candidate := range candidates {
+			fmt.Printf("\t%s %s\n", candidate.GetKind(), candidate.GetName())
+		}
+		kubeRemoveTemplates()
+		os.Exit(1)
+	}
+
+	workloadObject := candidates[0]
+	switch workloadObject.GetKind() {
+	case "StatefulSet":
+		return &statefulSetWorkload{name: workloadObject.GetName()}, workloadObject
+	case "DaemonSet":
+		return &daemonSetWorkload{name: workloadObject.GetName()}, workloadObject
+	default:
+		return &cronJobWorkload{name: workloadObject.GetName()}, workloadObject
+	}
+}
+
+// kubeCurrentWorkload finds the strategy for the commands which act on what is already running (eg. 'scale'). These
+// have to work even when the Kubernetes files don't (eg. to roll back from a broken release), so a live Deployment
+// decides it without them, and the Deployment strategy is the fallback if the files can't be filled out or read.
+func kubeCurrentWorkload() workloadStrategy {
+	isLiveDeployments := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch, "kubedeploy-is-live": "true"})
+	if len(isLiveDeployments.Items) > 0 {
+		return &deploymentWorkload{}
+	}
+
+	files, err := kubeTryMakeTemplates()
+	var objects []*unstructured.Unstructured
+	if err == nil {
+		objects, err = kubeDecodeTemplates(files)
+	}
+	kubeRemoveTemplates()
+	if err != nil {
+		fmt.Printf("=> Heads up: %s\n=> So I'll assume it's a Deployment.\n", err)
+		return &deploymentWorkload{}
+	}
+
+	var candidates []*unstructured.Unstructured
+	for _, object := range objects {
+		switch object.GetKind() {
+		case "Deployment":
+			if object.GetName() == repoConfig.ReleaseName {
+				return &deploymentWorkload{}
+			}
+		case "StatefulSet", "DaemonSet", "CronJob":
+			candidates = append(candidates, object)
+		}
+	}
+	if len(candidates) != 1 {
+		return &deploymentWorkload{}
+	}
+	switch candidates[0].GetKind() {
+	case "StatefulSet":
+		return &statefulSetWorkload{name: candidates[0].GetName()}
+	case "DaemonSet":
+		return &daemonSetWorkload{name: candidates[0].GetName()}
+	default:
+		return &cronJobWorkload{name: candidates[0].GetName()}
+	}
+}
+
+// kubeBailOutAndExit is the end of a rollout that didn't work out, once things were put back the way they were
+func kubeBailOutAndExit() {
+	historyFinish("failed")
+	kubeRemoveTemplates()
+	cli.UnlockAfterRollout(repoConfig.Application.Name)
+	log.Fatal("=> Sorry it didn't work out - better luck next time!\n\n")
+}
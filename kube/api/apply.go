@@ -0,0 +1,166 @@
+package kubeapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+)
+
+// FieldManager is the name kube-deploy's changes are recorded under in the objects' managed fields
+const FieldManager = "kube-deploy"
+
+// ObjectResult : what applying (or deleting) a single object did
+type ObjectResult struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Action    string // 'created', 'configured' or 'unchanged' - or 'deleted' or 'already deleted'
+}
+
+func (r ObjectResult) String() string {
+	return fmt.Sprintf("%s/%s %s", r.Kind, r.Name, r.Action)
+}
+
+// Applier applies manifests with server-side apply. It only needs a dynamic client and a REST mapper,
+// so it can also run against a fake dynamic client and a static mapper.
+type Applier struct {
+	Client    dynamic.Interface
+	Mapper    meta.RESTMapper
+	Namespace string // used for namespaced objects which don't set their namespace
+}
+
+var applier *Applier
+
+// resettableMapper : a REST mapper which caches what it found through discovery, like the DeferredDiscoveryRESTMapper
+type resettableMapper interface {
+	Reset()
+}
+
+// ApplyObjects applies objects which were already decoded (and possibly changed) to the cluster
+func ApplyObjects(objects []*unstructured.Unstructured) ([]ObjectResult, error) {
+	return applier.Apply(objects)
+}
+
+// DecodeManifests splits YAML (or JSON) manifests into their objects, expanding any lists
+func DecodeManifests(manifests []byte) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(manifests), 4096)
+	for {
+		document := map[string]interface{}{}
+		if err := decoder.Decode(&document); err == io.EOF {
+			return objects, nil
+		} else if err != nil {
+			return objects, fmt.Errorf("couldn't decode the manifest: %v", err)
+		}
+		if len(document) == 0 { // empty documents, eg. between two '---'
+			continue
+		}
+
+		object := &unstructured.Unstructured{Object: document}
+		if !object.IsList() {
+			objects = append(objects, object)
+			continue
+		}
+		err := object.EachListItem(func(item runtime.Object) error {
+			objects = append(objects, item.(*unstructured.Unstructured))
+			return nil
+		})
+		if err != nil {
+			return objects, err
+		}
+	}
+}
+
+// Apply applies the objects in order, stopping at the first one which fails.
+// Returns the results of the objects that were applied.
+func (a *Applier) Apply(objects []*unstructured.Unstructured) ([]ObjectResult, error) {
+	var results []ObjectResult
+	for _, object := range objects {
+		result, err := a.applyObject(object)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (a *Applier) applyObject(object *unstructured.Unstructured) (ObjectResult, error) {
+	gvk := object.GroupVersionKind()
+	result := ObjectResult{Kind: object.GetKind(), Name: object.GetName()}
+	resource, err := a.resourceFor(object)
+	if err != nil {
+		return result, err
+	}
+	result.Namespace = object.GetNamespace()
+
+	previousVersion := ""
+	existing, err := resource.Get(object.GetName(), metav1.GetOptions{})
+	if err == nil {
+		previousVersion = existing.GetResourceVersion()
+	} else if !errors.IsNotFound(err) {
+		return result, fmt.Errorf("couldn't get %s %s: %v", gvk.Kind, object.GetName(), err)
+	}
+
+	body, err := json.Marshal(object.Object)
+	if err != nil {
+		return result, err
+	}
+	// kube-deploy owns the manifests, so it takes over fields that were last set by someone else (eg. with kubectl)
+	force := true
+	applied, err := resource.Patch(object.GetName(), types.ApplyPatchType, body, metav1.PatchOptions{
+		FieldManager: FieldManager,
+		Force:        &force,
+	})
+	if err != nil {
+		return result, fmt.Errorf("applying %s %s failed: %v", gvk.Kind, object.GetName(), err)
+	}
+
+	switch previousVersion {
+	case "":
+		result.Action = "created"
+	case applied.GetResourceVersion():
+		result.Action = "unchanged"
+	default:
+		result.Action = "configured"
+	}
+	return result, nil
+}
+
+// resourceFor finds the API resource of the object through discovery, and puts namespaced objects without
+// a namespace into the default namespace
+func (a *Applier) resourceFor(object *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	gvk := object.GroupVersionKind()
+	if object.GetName() == "" {
+		return nil, fmt.Errorf("a %s in the manifest has no name", gvk.Kind)
+	}
+
+	mapping, err := a.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	// The discovery mapper keeps what it found the first time, so it only knows about a kind added since then (eg. by
+	// a CRD in an earlier document) once it's reset
+	if mapper, ok := a.Mapper.(resettableMapper); ok && meta.IsNoMatchError(err) {
+		mapper.Reset()
+		mapping, err = a.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("the cluster doesn't know %s %s: %v", gvk.GroupVersion(), gvk.Kind, err)
+	}
+
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return a.Client.Resource(mapping.Resource), nil
+	}
+	if object.GetNamespace() == "" {
+		object.SetNamespace(a.Namespace)
+	}
+	return a.Client.Resource(mapping.Resource).Namespace(object.GetNamespace()), nil
+}
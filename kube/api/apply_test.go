@@ -0,0 +1,199 @@
+package kubeapi
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var (
+	configMapKind = schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	crdKind       = schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}
+	widgetKind    = schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+)
+
+// discoveryMapper : a REST mapper which, like the discovery mapper, only learns about the kinds the cluster got
+// since it was created when it's reset
+type discoveryMapper struct {
+	*meta.DefaultRESTMapper
+	added  []schema.GroupVersionKind // the kinds the cluster knows about, but the mapper doesn't yet
+	resets int
+}
+
+func (m *discoveryMapper) Reset() {
+	for _, gvk := range m.added {
+		m.Add(gvk, meta.RESTScopeNamespace)
+	}
+	m.added = nil
+	m.resets++
+}
+
+func newTestMapper(added ...schema.GroupVersionKind) *discoveryMapper {
+	mapper := &discoveryMapper{DefaultRESTMapper: meta.NewDefaultRESTMapper(nil), added: added}
+	mapper.Add(configMapKind, meta.RESTScopeNamespace)
+	mapper.Add(crdKind, meta.RESTScopeRoot)
+	return mapper
+}
+
+// newTestApplier returns an Applier with a fake dynamic client, and the tracker holding the fake cluster's objects.
+// The fake client can't do server-side apply, so a reactor does: it creates or replaces the object, and bumps the
+// resource version if anything changed.
+func newTestApplier(mapper meta.RESTMapper, objects ...runtime.Object) (*Applier, k8stesting.ObjectTracker) {
+	scheme := runtime.NewScheme()
+	client := fake.NewSimpleDynamicClient(scheme)
+	tracker := k8stesting.NewObjectTracker(scheme, serializer.NewCodecFactory(scheme).UniversalDecoder())
+	for _, object := range objects {
+		if err := tracker.Add(object); err != nil {
+			panic(err)
+		}
+	}
+	client.PrependReactor("*", "*", k8stesting.ObjectReaction(tracker))
+
+	version := 100
+	client.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		applied := &unstructured.Unstructured{}
+		if err := json.Unmarshal(patch.GetPatch(), &applied.Object); err != nil {
+			return true, nil, err
+		}
+
+		existing, err := tracker.Get(patch.GetResource(), patch.GetNamespace(), patch.GetName())
+		if errors.IsNotFound(err) {
+			version++
+			applied.SetResourceVersion(strconv.Itoa(version))
+			return true, applied, tracker.Create(patch.GetResource(), applied, patch.GetNamespace())
+		} else if err != nil {
+			return true, nil, err
+		}
+		applied.SetResourceVersion(existing.(*unstructured.Unstructured).GetResourceVersion())
+		if !equality.Semantic.DeepEqual(existing.(*unstructured.Unstructured).Object, applied.Object) {
+			version++
+			applied.SetResourceVersion(strconv.Itoa(version))
+		}
+		return true, applied, tracker.Update(patch.GetResource(), applied, patch.GetNamespace())
+	})
+	return &Applier{Client: client, Mapper: mapper, Namespace: "default"}, tracker
+}
+
+func decodeTestManifests(t *testing.T, manifests string) []*unstructured.Unstructured {
+	objects, err := DecodeManifests([]byte(manifests))
+	if err != nil {
+		t.Fatalf("decoding the manifests: %v", err)
+	}
+	return objects
+}
+
+func TestApplyCreatesConfiguresAndLeavesUnchanged(t *testing.T) {
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(configMapKind)
+	existing.SetNamespace("default")
+	existing.SetName("settings")
+	existing.SetResourceVersion("1")
+	unstructured.SetNestedField(existing.Object, "old", "data", "value")
+	applier, _ := newTestApplier(newTestMapper(), existing)
+
+	objects := decodeTestManifests(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  value: new
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: extra
+data:
+  value: extra
+`)
+	results, err := applier.Apply(objects)
+	if err != nil {
+		t.Fatalf("applying failed: %v", err)
+	}
+	if len(results) != 2 || results[0].Action != "configured" || results[1].Action != "created" {
+		t.Fatalf("expected 'configured' and 'created', got %v", results)
+	}
+	if results[1].Namespace != "default" {
+		t.Errorf("expected the ConfigMap without a namespace to go into 'default', got '%s'", results[1].Namespace)
+	}
+
+	results, err = applier.Apply(decodeTestManifests(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: extra
+  namespace: default
+data:
+  value: extra
+`))
+	if err != nil {
+		t.Fatalf("applying again failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Action != "unchanged" {
+		t.Fatalf("expected 'unchanged', got %v", results)
+	}
+}
+
+func TestApplyCustomResourceAfterItsDefinition(t *testing.T) {
+	mapper := newTestMapper(widgetKind)
+	applier, tracker := newTestApplier(mapper)
+
+	results, err := applier.Apply(decodeTestManifests(t, `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: gadget
+`))
+	if err != nil {
+		t.Fatalf("applying failed: %v", err)
+	}
+	if len(results) != 2 || results[1].Action != "created" {
+		t.Fatalf("expected the Widget to be created, got %v", results)
+	}
+	if mapper.resets != 1 {
+		t.Errorf("expected the mapper to be reset once, got %d resets", mapper.resets)
+	}
+	widgets := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+	if _, err := tracker.Get(widgets, "default", "gadget"); err != nil {
+		t.Errorf("the Widget isn't in the cluster: %v", err)
+	}
+}
+
+func TestApplyUnknownKind(t *testing.T) {
+	mapper := newTestMapper()
+	applier, _ := newTestApplier(mapper)
+
+	_, err := applier.Apply(decodeTestManifests(t, `
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: gadget
+`))
+	if err == nil || !strings.Contains(err.Error(), "the cluster doesn't know") {
+		t.Fatalf("expected an unknown kind error, got %v", err)
+	}
+	if mapper.resets != 1 {
+		t.Errorf("expected the mapper to be reset once, got %d resets", mapper.resets)
+	}
+}
@@ -0,0 +1,53 @@
+package kubeapi
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DeleteObjects deletes the objects from the cluster, whatever their kind. With dryRun, the API server only checks
+// that they could be deleted.
+func DeleteObjects(objects []*unstructured.Unstructured, dryRun bool) ([]ObjectResult, []error) {
+	return applier.Delete(objects, dryRun)
+}
+
+// Delete deletes the objects in the reverse order of the manifests (so that eg. a Namespace goes last).
+// Objects which are already gone count as deleted, and a failure doesn't stop the other objects from being deleted.
+func (a *Applier) Delete(objects []*unstructured.Unstructured, dryRun bool) ([]ObjectResult, []error) {
+	var (
+		results []ObjectResult
+		errs    []error
+	)
+	deletePolicy := metav1.DeletePropagationForeground
+	options := &metav1.DeleteOptions{PropagationPolicy: &deletePolicy}
+	if dryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+
+	for i := len(objects) - 1; i >= 0; i-- {
+		object := objects[i]
+		result := ObjectResult{Kind: object.GetKind(), Name: object.GetName(), Action: "deleted"}
+		resource, err := a.resourceFor(object)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result.Namespace = object.GetNamespace()
+
+		err = resource.Delete(object.GetName(), options)
+		switch {
+		case errors.IsNotFound(err):
+			result.Action = "already deleted"
+		case err != nil:
+			errs = append(errs, fmt.Errorf("deleting %s %s failed: %v", object.GetKind(), object.GetName(), err))
+			continue
+		case dryRun:
+			result.Action = "deleted (dry run)"
+		}
+		results = append(results, result)
+	}
+	return results, errs
+}
@@ -0,0 +1,231 @@
+package kubeapi
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// APIRemoval : an API version of a kind which Kubernetes deprecated, and then stopped serving
+type APIRemoval struct {
+	GroupVersion string
+	Kind         string
+	DeprecatedIn string // the Kubernetes version, eg. '1.14'
+	RemovedIn    string
+	Replacement  string // the group version to use instead (empty if there is none)
+	Mechanical   bool   // whether changing the apiVersion is all it takes to move to the replacement
+	Note         string // what else has to change, if it isn't mechanical
+}
+
+// APIRemovals is the built-in table of removed API versions, for when the cluster can't be asked
+var APIRemovals = []APIRemoval{
+	{"extensions/v1beta1", "Deployment", "1.9", "1.16", "apps/v1", true, ""},
+	{"extensions/v1beta1", "DaemonSet", "1.9", "1.16", "apps/v1", true, ""},
+	{"extensions/v1beta1", "ReplicaSet", "1.9", "1.16", "apps/v1", true, ""},
+	{"apps/v1beta1", "Deployment", "1.9", "1.16", "apps/v1", true, ""},
+	{"apps/v1beta1", "StatefulSet", "1.9", "1.16", "apps/v1", true, ""},
+	{"apps/v1beta2", "Deployment", "1.9", "1.16", "apps/v1", true, ""},
+	{"apps/v1beta2", "StatefulSet", "1.9", "1.16", "apps/v1", true, ""},
+	{"apps/v1beta2", "DaemonSet", "1.9", "1.16", "apps/v1", true, ""},
+	{"apps/v1beta2", "ReplicaSet", "1.9", "1.16", "apps/v1", true, ""},
+	{"extensions/v1beta1", "NetworkPolicy", "1.9", "1.16", "networking.k8s.io/v1", true, ""},
+	{"extensions/v1beta1", "PodSecurityPolicy", "1.11", "1.16", "policy/v1beta1", true, ""},
+	{"extensions/v1beta1", "Ingress", "1.14", "1.22", "networking.k8s.io/v1beta1", true, ""},
+	{"networking.k8s.io/v1beta1", "Ingress", "1.19", "1.22", "networking.k8s.io/v1", false,
+		"the backends changed to 'service: {name, port}', and every path needs a 'pathType'"},
+	{"networking.k8s.io/v1beta1", "IngressClass", "1.19", "1.22", "networking.k8s.io/v1", true, ""},
+	{"rbac.authorization.k8s.io/v1beta1", "Role", "1.17", "1.22", "rbac.authorization.k8s.io/v1", true, ""},
+	{"rbac.authorization.k8s.io/v1beta1", "ClusterRole", "1.17", "1.22", "rbac.authorization.k8s.io/v1", true, ""},
+	{"rbac.authorization.k8s.io/v1beta1", "RoleBinding", "1.17", "1.22", "rbac.authorization.k8s.io/v1", true, ""},
+	{"rbac.authorization.k8s.io/v1beta1", "ClusterRoleBinding", "1.17", "1.22", "rbac.authorization.k8s.io/v1", true, ""},
+	{"scheduling.k8s.io/v1beta1", "PriorityClass", "1.14", "1.22", "scheduling.k8s.io/v1", true, ""},
+	{"storage.k8s.io/v1beta1", "StorageClass", "1.6", "1.22", "storage.k8s.io/v1", true, ""},
+	{"coordination.k8s.io/v1beta1", "Lease", "1.14", "1.22", "coordination.k8s.io/v1", true, ""},
+	{"apiregistration.k8s.io/v1beta1", "APIService", "1.19", "1.22", "apiregistration.k8s.io/v1", true, ""},
+	{"apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", "1.16", "1.22", "apiextensions.k8s.io/v1", false,
+		"the schema moved to 'spec.versions[*].schema', and has to be structural"},
+	{"admissionregistration.k8s.io/v1beta1", "MutatingWebhookConfiguration", "1.16", "1.22", "admissionregistration.k8s.io/v1", false,
+		"every webhook needs 'admissionReviewVersions' and 'sideEffects'"},
+	{"admissionregistration.k8s.io/v1beta1", "ValidatingWebhookConfiguration", "1.16", "1.22", "admissionregistration.k8s.io/v1", false,
+		"every webhook needs 'admissionReviewVersions' and 'sideEffects'"},
+	{"certificates.k8s.io/v1beta1", "CertificateSigningRequest", "1.19", "1.22", "certificates.k8s.io/v1", false,
+		"'signerName' is required"},
+	{"batch/v1beta1", "CronJob", "1.21", "1.25", "batch/v1", true, ""},
+	{"policy/v1beta1", "PodDisruptionBudget", "1.21", "1.25", "policy/v1", true, ""},
+	{"policy/v1beta1", "PodSecurityPolicy", "1.21", "1.25", "", false,
+		"there is no replacement - Pod Security Admission took over"},
+	{"autoscaling/v2beta1", "HorizontalPodAutoscaler", "1.22", "1.25", "autoscaling/v2", false,
+		"the metric targets moved to 'target: {type, averageValue, averageUtilization, value}'"},
+	{"autoscaling/v2beta2", "HorizontalPodAutoscaler", "1.23", "1.26", "autoscaling/v2", true, ""},
+}
+
+// FindAPIRemoval looks up a group version and kind in the removal table
+func FindAPIRemoval(groupVersion string, kind string) (APIRemoval, bool) {
+	for _, removal := range APIRemovals {
+		if removal.GroupVersion == groupVersion && removal.Kind == kind {
+			return removal, true
+		}
+	}
+	return APIRemoval{}, false
+}
+
+// MigrationTarget follows the mechanical migrations from a group version, and returns the furthest one the cluster
+// serves - past any the cluster doesn't serve (any more), or all the way if the cluster can't be asked. Also returns
+// what needs changing by hand, if the migrations end at a change which isn't mechanical, or at a group version the
+// cluster doesn't serve.
+func MigrationTarget(groupVersion string, kind string) (string, *APIRemoval) {
+	chain := []string{groupVersion}
+	var handChange *APIRemoval
+	for {
+		removal, found := FindAPIRemoval(chain[len(chain)-1], kind)
+		if !found {
+			break
+		}
+		if removal.Replacement == "" || !removal.Mechanical {
+			handChange = &removal
+			break
+		}
+		chain = append(chain, removal.Replacement)
+	}
+	if len(chain) == 1 && handChange == nil {
+		return groupVersion, nil // not in the removal table, so there's nothing to migrate
+	}
+
+	// An older cluster may not serve the newer group versions yet, so stop at the newest one it does serve
+	for i := len(chain) - 1; i >= 0; i-- {
+		served, known := ServesKind(chain[i], kind)
+		if !known {
+			break
+		}
+		if served {
+			if i < len(chain)-1 {
+				return chain[i], nil // the rest of the migrations have to wait for a newer cluster
+			}
+			return chain[i], handChange
+		}
+		if i == 0 && handChange == nil {
+			// None of them are served, and there's nowhere else to go
+			return chain[len(chain)-1], &APIRemoval{GroupVersion: chain[len(chain)-1], Kind: kind,
+				Note: fmt.Sprintf("the cluster (Kubernetes %s) doesn't serve it", ClusterVersion())}
+		}
+	}
+	return chain[len(chain)-1], handChange
+}
+
+// APIVersionProblem : an object in the manifests with an apiVersion which is deprecated, or not served at all
+type APIVersionProblem struct {
+	Kind         string
+	Name         string
+	GroupVersion string
+	Fatal        bool // the cluster doesn't serve the apiVersion, so the object can't be applied
+	Message      string
+}
+
+func (p APIVersionProblem) String() string {
+	return fmt.Sprintf("%s %s (%s) %s", p.Kind, p.Name, p.GroupVersion, p.Message)
+}
+
+// servedKinds caches which kinds the cluster serves in each group version (nil if the group version isn't served)
+var servedKinds = map[string]map[string]bool{}
+
+// clusterUnreachable is set once discovery failed, so that working offline doesn't wait for every lookup to time out
+var clusterUnreachable bool
+
+// ServesKind asks the cluster whether it serves a kind in a group version. known is false if the cluster
+// couldn't be asked (eg. when working offline).
+func ServesKind(groupVersion string, kind string) (served bool, known bool) {
+	if apiDiscovery == nil || clusterUnreachable {
+		return false, false
+	}
+	kinds, cached := servedKinds[groupVersion]
+	if !cached {
+		resources, err := apiDiscovery.ServerResourcesForGroupVersion(groupVersion)
+		if err != nil && !errors.IsNotFound(err) {
+			clusterUnreachable = true
+			return false, false
+		}
+		if resources != nil {
+			kinds = map[string]bool{}
+			for _, resource := range resources.APIResources {
+				kinds[resource.Kind] = true
+			}
+		}
+		servedKinds[groupVersion] = kinds
+	}
+	return kinds[kind], true
+}
+
+// ClusterVersion returns the Kubernetes version of the cluster (eg. '1.17'), or "" if the cluster can't be reached
+func ClusterVersion() string {
+	if apiDiscovery == nil || clusterUnreachable {
+		return ""
+	}
+	version, err := apiDiscovery.ServerVersion()
+	if err != nil {
+		clusterUnreachable = true
+		return ""
+	}
+	// Managed clusters add extras to the minor version, like GKE's '17+'
+	return version.Major + "." + strings.TrimRight(version.Minor, "+")
+}
+
+// CheckAPIVersions checks the apiVersion of every object against the cluster's discovery: an apiVersion the cluster
+// doesn't serve is fatal, and one from the removal table gets a warning. If the cluster can't be reached,
+// only the removal table is used. Kinds defined by a CustomResourceDefinition in the objects themselves are skipped.
+func CheckAPIVersions(objects []*unstructured.Unstructured) []APIVersionProblem {
+	clusterVersion := ClusterVersion()
+	if clusterVersion == "" {
+		fmt.Println("=> Heads up: couldn't reach the cluster, so the apiVersions are only checked against the built-in list of removed APIs.")
+	}
+
+	definedKinds := map[string]bool{}
+	for _, object := range objects {
+		if object.GetKind() != "CustomResourceDefinition" {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(object.Object, "spec", "group")
+		kind, _, _ := unstructured.NestedString(object.Object, "spec", "names", "kind")
+		definedKinds[group+"/"+kind] = true
+	}
+
+	var problems []APIVersionProblem
+	for _, object := range objects {
+		gvk := object.GroupVersionKind()
+		if definedKinds[gvk.Group+"/"+gvk.Kind] {
+			continue
+		}
+		problem := APIVersionProblem{Kind: gvk.Kind, Name: object.GetName(), GroupVersion: object.GetAPIVersion()}
+		removal, deprecated := FindAPIRemoval(problem.GroupVersion, gvk.Kind)
+
+		served, known := false, false
+		if clusterVersion != "" {
+			served, known = ServesKind(problem.GroupVersion, gvk.Kind)
+		}
+		switch {
+		case known && !served:
+			problem.Fatal = true
+			problem.Message = fmt.Sprintf("isn't served by the cluster (Kubernetes %s)", clusterVersion)
+			if deprecated {
+				problem.Message += fmt.Sprintf(": it was removed in Kubernetes %s", removal.RemovedIn)
+			}
+		case deprecated:
+			problem.Message = fmt.Sprintf("is deprecated since Kubernetes %s, and removed in Kubernetes %s", removal.DeprecatedIn, removal.RemovedIn)
+		default:
+			continue
+		}
+
+		if deprecated && removal.Replacement != "" {
+			problem.Message += fmt.Sprintf(" - use %s instead", removal.Replacement)
+			if removal.Mechanical {
+				problem.Message += " ('kube-deploy migrate-manifests' can do that for you)"
+			}
+		}
+		if deprecated && removal.Note != "" {
+			problem.Message += fmt.Sprintf(" (%s)", removal.Note)
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
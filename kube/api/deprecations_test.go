@@ -0,0 +1,152 @@
+package kubeapi
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// notFoundDiscovery : the fake discovery, but answering NotFound for a group version it doesn't serve, like the API
+// server does (the fake answers with a plain error)
+type notFoundDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+func (d notFoundDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	for _, resources := range d.Resources {
+		if resources.GroupVersion == groupVersion {
+			return resources, nil
+		}
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{}, groupVersion)
+}
+
+// useTestCluster points the discovery at a cluster of the given version, serving the given 'group/version Kind's -
+// or at no cluster at all, for a version of ""
+func useTestCluster(clusterVersion string, served ...string) {
+	servedKinds, clusterUnreachable = map[string]map[string]bool{}, false
+	if clusterVersion == "" {
+		apiDiscovery = nil
+		return
+	}
+	resources := map[string]*metav1.APIResourceList{}
+	for _, groupVersionKind := range served {
+		split := strings.SplitN(groupVersionKind, " ", 2)
+		if resources[split[0]] == nil {
+			resources[split[0]] = &metav1.APIResourceList{GroupVersion: split[0]}
+		}
+		resources[split[0]].APIResources = append(resources[split[0]].APIResources, metav1.APIResource{Kind: split[1]})
+	}
+	fake := &fakediscovery.FakeDiscovery{Fake: &k8stesting.Fake{}}
+	for _, list := range resources {
+		fake.Resources = append(fake.Resources, list)
+	}
+	versionParts := strings.SplitN(clusterVersion, ".", 2)
+	fake.FakedServerVersion = &version.Info{Major: versionParts[0], Minor: versionParts[1]}
+	apiDiscovery = notFoundDiscovery{fake}
+}
+
+var (
+	cluster113 = []string{"extensions/v1beta1 Ingress", "extensions/v1beta1 Deployment", "apps/v1 Deployment", "batch/v1beta1 CronJob"}
+	cluster115 = []string{"extensions/v1beta1 Ingress", "networking.k8s.io/v1beta1 Ingress", "apps/v1 Deployment", "batch/v1beta1 CronJob"}
+	cluster122 = []string{"networking.k8s.io/v1 Ingress", "apps/v1 Deployment", "batch/v1beta1 CronJob", "batch/v1 CronJob"}
+)
+
+func TestMigrationTarget(t *testing.T) {
+	tests := []struct {
+		name           string
+		clusterVersion string
+		served         []string
+		groupVersion   string
+		kind           string
+		target         string
+		handChange     string // part of the note of the hand change, if there is one
+	}{
+		{"offline, mechanical", "", nil, "extensions/v1beta1", "Deployment", "apps/v1", ""},
+		{"offline, up to a hand change", "", nil, "extensions/v1beta1", "Ingress", "networking.k8s.io/v1beta1", "pathType"},
+		{"past versions the cluster doesn't serve any more", "1.22", cluster122, "extensions/v1beta1", "Ingress", "networking.k8s.io/v1beta1", "pathType"},
+		{"up to a hand change the cluster can take", "1.15", cluster115, "extensions/v1beta1", "Ingress", "networking.k8s.io/v1beta1", "pathType"},
+		{"not before the cluster serves the new version", "1.13", cluster113, "extensions/v1beta1", "Ingress", "extensions/v1beta1", ""},
+		{"served all the way", "1.22", cluster122, "batch/v1beta1", "CronJob", "batch/v1", ""},
+		{"to a version the cluster doesn't serve yet", "1.13", cluster113, "batch/v1beta1", "CronJob", "batch/v1beta1", ""},
+		{"nothing the cluster serves", "1.22", []string{"apps/v1 Deployment"}, "batch/v1beta1", "CronJob", "batch/v1", "doesn't serve it"},
+		{"no replacement", "", nil, "policy/v1beta1", "PodSecurityPolicy", "policy/v1beta1", "no replacement"},
+		{"already current", "1.22", cluster122, "apps/v1", "Deployment", "apps/v1", ""},
+		{"not in the removal table", "1.22", cluster122, "example.com/v1", "Widget", "example.com/v1", ""},
+	}
+	defer useTestCluster("")
+	for _, test := range tests {
+		useTestCluster(test.clusterVersion, test.served...)
+		target, handChange := MigrationTarget(test.groupVersion, test.kind)
+		if target != test.target {
+			t.Errorf("%s: expected %s %s to migrate to %s, got %s", test.name, test.kind, test.groupVersion, test.target, target)
+		}
+		switch {
+		case test.handChange == "" && handChange != nil:
+			t.Errorf("%s: expected no hand change, got '%s'", test.name, handChange.Note)
+		case test.handChange != "" && handChange == nil:
+			t.Errorf("%s: expected a hand change with '%s', got none", test.name, test.handChange)
+		case test.handChange != "" && !strings.Contains(handChange.Note, test.handChange):
+			t.Errorf("%s: expected a hand change with '%s', got '%s'", test.name, test.handChange, handChange.Note)
+		}
+	}
+}
+
+func TestCheckAPIVersions(t *testing.T) {
+	object := func(apiVersion string, kind string, name string) *unstructured.Unstructured {
+		object := &unstructured.Unstructured{}
+		object.SetAPIVersion(apiVersion)
+		object.SetKind(kind)
+		object.SetName(name)
+		return object
+	}
+	definition := object("apiextensions.k8s.io/v1", "CustomResourceDefinition", "widgets.example.com")
+	unstructured.SetNestedField(definition.Object, "example.com", "spec", "group")
+	unstructured.SetNestedField(definition.Object, "Widget", "spec", "names", "kind")
+	objects := []*unstructured.Unstructured{
+		object("extensions/v1beta1", "Ingress", "web"),
+		object("batch/v1beta1", "CronJob", "report"),
+		object("apps/v1", "Deployment", "api"),
+		object("example.com/v1", "Widget", "gadget"),
+		definition,
+	}
+
+	tests := []struct {
+		name           string
+		clusterVersion string
+		served         []string
+		problems       []string // '<name> fatal|warning <part of the message>'
+	}{
+		{"Kubernetes 1.22", "1.22", append(cluster122, "apiextensions.k8s.io/v1 CustomResourceDefinition"), []string{
+			"web fatal removed in Kubernetes 1.22",
+			"report warning removed in Kubernetes 1.25",
+		}},
+		{"offline", "", nil, []string{
+			"web warning use networking.k8s.io/v1beta1 instead ('kube-deploy migrate-manifests' can do that for you)",
+			"report warning use batch/v1 instead",
+		}},
+	}
+	defer useTestCluster("")
+	for _, test := range tests {
+		useTestCluster(test.clusterVersion, test.served...)
+		problems := CheckAPIVersions(objects)
+		if len(problems) != len(test.problems) {
+			t.Errorf("%s: expected %d problems, got %v", test.name, len(test.problems), problems)
+			continue
+		}
+		for i, expected := range test.problems {
+			split := strings.SplitN(expected, " ", 3)
+			problem := problems[i]
+			if problem.Name != split[0] || problem.Fatal != (split[1] == "fatal") || !strings.Contains(problem.Message, split[2]) {
+				t.Errorf("%s: expected '%s', got %s (fatal: %t)", test.name, expected, problem, problem.Fatal)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package kubeapi
+
+import (
+	"bufio"
+	"fmt"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// RunJob creates the Job in the given namespace, streams the logs of its pods while they run, and waits for it to
+// finish. Returns whether the Job succeeded. The Job should have a deadline, otherwise a pod that never starts
+// (eg. because its image can't be pulled) will keep this waiting forever.
+func RunJob(jobNamespace string, job *batchv1.Job, logPrefix string) (bool, error) {
+	created, err := clientSet.BatchV1().Jobs(jobNamespace).Create(job)
+	if err != nil {
+		return false, fmt.Errorf("couldn't create the job %s: %v", job.Name, err)
+	}
+	fmt.Printf("=> Started job %s in namespace %s.\n", created.Name, jobNamespace)
+
+	streamed := map[string]bool{}
+	waitingReasons := map[string]string{}
+	for {
+		pods, err := clientSet.CoreV1().Pods(jobNamespace).List(metav1.ListOptions{LabelSelector: "job-name=" + created.Name})
+		if err != nil {
+			return false, err
+		}
+		for _, pod := range pods.Items {
+			if streamed[pod.Name] {
+				continue
+			}
+			if pod.Status.Phase == v1.PodPending {
+				// Explain why the pod isn't starting (eg. 'ImagePullBackOff'), once per reason
+				for _, status := range pod.Status.ContainerStatuses {
+					if status.State.Waiting != nil && status.State.Waiting.Reason != waitingReasons[pod.Name] {
+						waitingReasons[pod.Name] = status.State.Waiting.Reason
+						fmt.Printf("=> Pod %s is waiting: %s %s\n", pod.Name, status.State.Waiting.Reason, status.State.Waiting.Message)
+					}
+				}
+				continue
+			}
+			streamed[pod.Name] = true
+			if err := streamPodLogs(jobNamespace, pod.Name, logPrefix); err != nil {
+				fmt.Printf("=> Couldn't stream the logs of pod %s: %s\n", pod.Name, err)
+			}
+		}
+
+		current, err := clientSet.BatchV1().Jobs(jobNamespace).Get(created.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, condition := range current.Status.Conditions {
+			if condition.Status != v1.ConditionTrue {
+				continue
+			}
+			switch condition.Type {
+			case batchv1.JobComplete:
+				return true, nil
+			case batchv1.JobFailed:
+				fmt.Printf("=> Job %s failed: %s %s\n", current.Name, condition.Reason, condition.Message)
+				return false, nil
+			}
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// DeleteJob deletes the Job along with its pods
+func DeleteJob(jobNamespace string, name string) {
+	deletePolicy := metav1.DeletePropagationBackground
+	if err := clientSet.BatchV1().Jobs(jobNamespace).
+		Delete(name, &metav1.DeleteOptions{
+			PropagationPolicy: &deletePolicy,
+		}); err != nil {
+		fmt.Printf("=> Couldn't delete the job %s: %s\n", name, err)
+	}
+}
+
+// ListJobs returns the Jobs in the namespace with all of the labels
+func ListJobs(jobNamespace string, labelFilter map[string]string) ([]batchv1.Job, error) {
+	jobs, err := clientSet.BatchV1().Jobs(jobNamespace).List(metav1.ListOptions{LabelSelector: labels.Set(labelFilter).String()})
+	if err != nil {
+		return nil, err
+	}
+	return jobs.Items, nil
+}
+
+// JobFinished is true once the Job has completed or failed
+func JobFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status == v1.ConditionTrue && (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamPodLogs prints the pod's logs until its container exits
+func streamPodLogs(podNamespace string, podName string, logPrefix string) error {
+	stream, err := clientSet.CoreV1().Pods(podNamespace).
+		GetLogs(podName, &v1.PodLogOptions{Follow: true}).
+		Stream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fmt.Printf("%s\t| %s\n", logPrefix, scanner.Text())
+	}
+	return scanner.Err()
+}
@@ -4,14 +4,21 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/api/extensions/v1beta1"
 
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/retry"
 
@@ -23,6 +30,9 @@ import (
 var clientSet *kubernetes.Clientset
 var namespace string
 
+// apiDiscovery gives up quickly, so that checking the manifests' API versions still works offline
+var apiDiscovery discovery.DiscoveryInterface
+
 func Setup(namespaceParam string) *kubernetes.Clientset {
 
 	var kubeconfig string
@@ -47,8 +57,24 @@ func Setup(namespaceParam string) *kubernetes.Clientset {
 		panic(err.Error())
 	}
 
+	// the dynamic client and discovery let manifests of any kind be applied
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientset.Discovery()))
+
+	discoveryConfig := rest.CopyConfig(config)
+	discoveryConfig.Timeout = 10 * time.Second
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(discoveryConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+
 	clientSet = clientset
 	namespace = namespaceParam
+	apiDiscovery = discoveryClient
+	applier = &Applier{Client: dynamicClient, Mapper: mapper, Namespace: namespaceParam}
 	return clientset
 }
 
@@ -81,6 +107,107 @@ func UpdateDeployment(name string, callback func(*appsv1.Deployment)) *appsv1.De
 	return deployment
 }
 
+// UpdateService gets the latest version of the Service, changes it with the callback, and updates it -
+// retrying if someone else changed it in the meantime
+func UpdateService(name string, callback func(*v1.Service)) (*v1.Service, error) {
+	var service *v1.Service
+
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var getErr error
+		service, getErr = clientSet.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		callback(service)
+		_, updateErr := clientSet.CoreV1().Services(namespace).Update(service)
+		return updateErr
+	})
+	if retryErr != nil {
+		return nil, fmt.Errorf("updating the Service %s failed: %v", name, retryErr)
+	}
+	fmt.Printf("=> Updated service %s.\n", service.Name)
+
+	return service, nil
+}
+
+// ListConfigMaps returns the ConfigMaps in the namespace with all of the labels
+func ListConfigMaps(labelFilter map[string]string) ([]v1.ConfigMap, error) {
+	configMaps, err := clientSet.CoreV1().ConfigMaps(namespace).List(metav1.ListOptions{LabelSelector: labels.Set(labelFilter).String()})
+	if err != nil {
+		return nil, err
+	}
+	return configMaps.Items, nil
+}
+
+func GetConfigMap(name string) (*v1.ConfigMap, error) {
+	return clientSet.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+}
+
+// UpdateConfigMapData changes the data of the ConfigMap with the callback - retrying if someone else changed it in
+// the meantime - or creates it with the labels, if it doesn't exist yet. If the callback returns an error, the
+// ConfigMap is left as it is.
+func UpdateConfigMapData(name string, configMapLabels map[string]string, callback func(data map[string]string) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := clientSet.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			configMap = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: configMapLabels}, Data: map[string]string{}}
+			if err := callback(configMap.Data); err != nil {
+				return err
+			}
+			_, err = clientSet.CoreV1().ConfigMaps(namespace).Create(configMap)
+			if errors.IsAlreadyExists(err) {
+				// Someone else created it first, so try again as an update
+				return errors.NewConflict(v1.Resource("configmaps"), name, err)
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		if err := callback(configMap.Data); err != nil {
+			return err
+		}
+		_, err = clientSet.CoreV1().ConfigMaps(namespace).Update(configMap)
+		return err
+	})
+}
+
+// DeleteConfigMapsAndSecrets deletes the ConfigMaps and Secrets with all of the labels. Returns what it deleted,
+// eg. 'Secret thumbs-1.2.0-master-abc1234-keys'.
+func DeleteConfigMapsAndSecrets(labelFilter map[string]string) ([]string, error) {
+	opts := metav1.ListOptions{LabelSelector: labels.Set(labelFilter).String()}
+	var deleted []string
+
+	configMaps, err := clientSet.CoreV1().ConfigMaps(namespace).List(opts)
+	if err != nil {
+		return deleted, err
+	}
+	for _, configMap := range configMaps.Items {
+		if err := clientSet.CoreV1().ConfigMaps(namespace).Delete(configMap.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return deleted, err
+		}
+		deleted = append(deleted, "ConfigMap "+configMap.Name)
+	}
+
+	secrets, err := clientSet.CoreV1().Secrets(namespace).List(opts)
+	if err != nil {
+		return deleted, err
+	}
+	for _, secret := range secrets.Items {
+		if err := clientSet.CoreV1().Secrets(namespace).Delete(secret.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return deleted, err
+		}
+		deleted = append(deleted, "Secret "+secret.Name)
+	}
+	return deleted, nil
+}
+
+func DeleteConfigMap(name string) error {
+	return clientSet.CoreV1().ConfigMaps(namespace).Delete(name, &metav1.DeleteOptions{})
+}
+
 func AddDeploymentLabel(deployment *appsv1.Deployment, key string, value string) {
 	existingLabels := deployment.GetLabels()
 	existingLabels[key] = value
@@ -102,25 +229,43 @@ func DeleteDeployment(deployment *appsv1.Deployment) {
 	}
 }
 
-func DeleteService(service *v1.Service) {
-	if err := clientSet.CoreV1().Services(namespace).
-		Delete(service.Name, nil); err != nil {
+// ListDeploymentReplicaSets returns the ReplicaSets controlled by the deployment
+func ListDeploymentReplicaSets(deployment *appsv1.Deployment) []appsv1.ReplicaSet {
+	opts := metav1.ListOptions{LabelSelector: labels.Set(deployment.Spec.Selector.MatchLabels).String()}
+
+	replicaSets, err := clientSet.AppsV1().ReplicaSets(namespace).List(opts)
+	if err != nil {
 		panic(err.Error())
 	}
+	var ownReplicaSets []appsv1.ReplicaSet
+	for _, rs := range replicaSets.Items {
+		if owner := metav1.GetControllerOf(&rs); owner != nil && owner.UID == deployment.UID {
+			ownReplicaSets = append(ownReplicaSets, rs)
+		}
+	}
+	return ownReplicaSets
 }
 
-func DeleteSecret(secret *v1.Secret) {
-	if err := clientSet.CoreV1().Secrets(namespace).
-		Delete(secret.Name, nil); err != nil {
-		panic(err.Error())
+// ListDeploymentPods returns the pods belonging to the deployment's own ReplicaSets (other deployments may share its selector)
+func ListDeploymentPods(deployment *appsv1.Deployment) []v1.Pod {
+	opts := metav1.ListOptions{LabelSelector: labels.Set(deployment.Spec.Selector.MatchLabels).String()}
+
+	ownReplicaSets := map[types.UID]bool{}
+	for _, rs := range ListDeploymentReplicaSets(deployment) {
+		ownReplicaSets[rs.UID] = true
 	}
-}
 
-func DeleteIngress(ingress *v1beta1.Ingress) {
-	if err := clientSet.ExtensionsV1beta1().Ingresses(namespace).
-		Delete(ingress.Name, nil); err != nil {
+	pods, err := clientSet.CoreV1().Pods(namespace).List(opts)
+	if err != nil {
 		panic(err.Error())
 	}
+	var deploymentPods []v1.Pod
+	for _, pod := range pods.Items {
+		if owner := metav1.GetControllerOf(&pod); owner != nil && ownReplicaSets[owner.UID] {
+			deploymentPods = append(deploymentPods, pod)
+		}
+	}
+	return deploymentPods
 }
 
 func ListDeployments(labelFilter map[string]string) *appsv1.DeploymentList {
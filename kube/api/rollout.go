@@ -0,0 +1,364 @@
+package kubeapi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// fatalWaitingReasons are reasons for a container not starting which won't fix themselves, so there's no point
+// in waiting for the progress deadline
+var fatalWaitingReasons = map[string]bool{
+	"InvalidImageName":           true,
+	"ErrImageNeverPull":          true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// imagePullReasons are reasons for a container not starting which may fix themselves (eg. the registry had a hiccup,
+// or the image is still being pushed), but usually mean the image doesn't exist, or can't be pulled with the
+// pod's credentials - so they only count as fatal once the pod has been trying for imagePullGracePeriod
+var imagePullReasons = map[string]bool{
+	"ErrImagePull":     true,
+	"ImagePullBackOff": true,
+}
+
+// imagePullGracePeriod is how long a pod gets to pull its images before the rollout gives up on it
+const imagePullGracePeriod = 2 * time.Minute
+
+// crashLoopRestarts is how often a container has to have crashed before the rollout gives up on it
+const crashLoopRestarts = 3
+
+// RolloutResult : how waiting for a workload's rollout ended
+type RolloutResult struct {
+	Kind        string // 'Deployment', 'StatefulSet' or 'DaemonSet'
+	Name        string
+	Complete    bool
+	Reason      string // why the rollout failed, eg. 'ProgressDeadlineExceeded' or 'CrashLoopBackOff'
+	Message     string
+	Events      []string // recent Warning events for the workload and its ReplicaSets (eg. a quota preventing new pods)
+	FailingPods []PodDiagnosis
+}
+
+// PodDiagnosis : what is known about why a pod isn't ready
+type PodDiagnosis struct {
+	Name       string
+	Containers []string // the state of each container, eg. 'app: waiting (CrashLoopBackOff), 4 restarts'
+	Events     []string // recent Warning events for the pod
+	LogTail    map[string][]string
+}
+
+func (r RolloutResult) String() string {
+	if r.Complete {
+		return fmt.Sprintf("%s %s rolled out", strings.ToLower(r.Kind), r.Name)
+	}
+	return fmt.Sprintf("%s %s failed to roll out: %s %s", strings.ToLower(r.Kind), r.Name, r.Reason, r.Message)
+}
+
+// rolloutProgress : how far a workload's rollout is, according to its status
+type rolloutProgress struct {
+	waitingFor string        // what the rollout is still waiting for - empty once it's done
+	failure    string        // the reason, if the controller reports that the rollout failed
+	message    string        // the controller's explanation of the failure
+	deadline   time.Duration // how long the rollout can go without progress
+}
+
+// rolloutWatch : how to follow the rollout of one kind of workload
+type rolloutWatch struct {
+	kind         string
+	name         string
+	progress     func() (rolloutProgress, error)
+	pods         func() []v1.Pod
+	eventObjects func() []string // the objects whose Warning events explain a failure, besides the pods
+	watch        func() (watch.Interface, error)
+	podSelector  func() *metav1.LabelSelector
+}
+
+// WaitForDeploymentRollout watches the Deployment until all of its replicas are updated and available, like
+// 'kubectl rollout status', but gives up when the progress deadline passes (or earlier, if a pod can't start
+// at all). When it fails, it prints what's wrong with the pods that aren't ready.
+func WaitForDeploymentRollout(name string) RolloutResult {
+	var deployment *appsv1.Deployment
+	return waitForRollout(rolloutWatch{
+		kind: "Deployment",
+		name: name,
+		progress: func() (rolloutProgress, error) {
+			var err error
+			if deployment, err = clientSet.AppsV1().Deployments(namespace).Get(name, metav1.GetOptions{}); err != nil {
+				return rolloutProgress{}, err
+			}
+			return deploymentProgress(deployment), nil
+		},
+		pods: func() []v1.Pod { return ListDeploymentPods(deployment) },
+		watch: func() (watch.Interface, error) {
+			return clientSet.AppsV1().Deployments(namespace).Watch(metav1.ListOptions{FieldSelector: "metadata.name=" + name})
+		},
+		podSelector: func() *metav1.LabelSelector { return deployment.Spec.Selector },
+		eventObjects: func() []string {
+			objects := []string{deployment.Name}
+			for _, rs := range ListDeploymentReplicaSets(deployment) {
+				objects = append(objects, rs.Name)
+			}
+			return objects
+		},
+	})
+}
+
+func deploymentProgress(deployment *appsv1.Deployment) rolloutProgress {
+	progress := rolloutProgress{deadline: 600 * time.Second}
+	if deployment.Spec.ProgressDeadlineSeconds != nil {
+		progress.deadline = time.Duration(*deployment.Spec.ProgressDeadlineSeconds) * time.Second
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	status := deployment.Status
+	switch {
+	case deployment.Generation > status.ObservedGeneration:
+		// Until the controller has seen the update, the conditions can still be about the previous rollout
+		progress.waitingFor = "the deployment controller to see the update"
+		return progress
+	case status.UpdatedReplicas < replicas:
+		progress.waitingFor = fmt.Sprintf("%d of %d new replicas to be created", replicas-status.UpdatedReplicas, replicas)
+	case status.Replicas > status.UpdatedReplicas:
+		progress.waitingFor = fmt.Sprintf("%d old replicas to be terminated", status.Replicas-status.UpdatedReplicas)
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		progress.waitingFor = fmt.Sprintf("%d of %d updated replicas to be available", status.UpdatedReplicas-status.AvailableReplicas, status.UpdatedReplicas)
+	}
+	for _, condition := range status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			progress.failure, progress.message = condition.Reason, condition.Message
+		}
+	}
+	return progress
+}
+
+// waitForRollout watches the workload and its pods until its rollout is done, or fails. Without a failure reported
+// by the controller, it gives up after the deadline passes without progress, or once a pod can't start at all.
+func waitForRollout(rollout rolloutWatch) RolloutResult {
+	result := RolloutResult{Kind: rollout.kind, Name: rollout.name}
+	lastProgress := time.Now()
+	lastWaitingFor := ""
+
+	var changes <-chan struct{}
+	stopWatching := func() {}
+	defer func() { stopWatching() }()
+	// Some things change without any events, like the deadline passing, or how long a pod has been pulling its image
+	recheck := time.NewTicker(10 * time.Second)
+	defer recheck.Stop()
+
+	for {
+		progress, err := rollout.progress()
+		if err != nil {
+			result.Reason, result.Message = "NotFound", err.Error()
+			if !errors.IsNotFound(err) {
+				result.Reason = "Error"
+			}
+			return result
+		}
+		if progress.waitingFor == "" {
+			fmt.Printf("=> %s %s successfully rolled out.\n", rollout.kind, rollout.name)
+			result.Complete = true
+			return result
+		}
+		if progress.waitingFor != lastWaitingFor {
+			fmt.Printf("=> Waiting for %s of %s...\n", progress.waitingFor, rollout.name)
+			lastWaitingFor = progress.waitingFor
+			lastProgress = time.Now()
+		}
+
+		result.Reason, result.Message = progress.failure, progress.message
+		// The controller only reports the deadline for rollouts it's progressing (eg. not for scaling down a paused deployment)
+		if result.Reason == "" && time.Since(lastProgress) > progress.deadline+30*time.Second {
+			result.Reason = "Timeout"
+			result.Message = fmt.Sprintf("no progress in %s while waiting for %s", progress.deadline, progress.waitingFor)
+		}
+		if result.Reason == "" {
+			result.Reason, result.Message = unrecoverablePodState(rollout.pods())
+		}
+		if result.Reason != "" {
+			for _, object := range rollout.eventObjects() {
+				result.Events = append(result.Events, warningEvents(object)...)
+			}
+			result.FailingPods = diagnosePods(rollout.pods())
+			printRolloutFailure(result)
+			return result
+		}
+
+		if changes == nil {
+			// The pod selector can't change, so the pods can be watched from the first look at the workload on
+			podSelector, err := metav1.LabelSelectorAsSelector(rollout.podSelector())
+			if err != nil {
+				result.Reason, result.Message = "Error", err.Error()
+				return result
+			}
+			changes, stopWatching = watchChanges(rollout.watch, func() (watch.Interface, error) {
+				return clientSet.CoreV1().Pods(namespace).Watch(metav1.ListOptions{LabelSelector: podSelector.String()})
+			})
+		}
+		select {
+		case <-changes:
+		case <-recheck.C:
+		}
+	}
+}
+
+// watchChanges keeps the watches open (the API server closes them every so often), and signals on the returned
+// channel whenever any of them has an event, until it's stopped
+func watchChanges(openWatches ...func() (watch.Interface, error)) (<-chan struct{}, func()) {
+	changes := make(chan struct{}, 1)
+	done := make(chan struct{})
+	for _, openWatch := range openWatches {
+		go func(openWatch func() (watch.Interface, error)) {
+			for {
+				if watcher, err := openWatch(); err == nil {
+					for open := true; open; {
+						select {
+						case <-done:
+							watcher.Stop()
+							return
+						case _, open = <-watcher.ResultChan():
+							select {
+							case changes <- struct{}{}:
+							default: // there's a change waiting to be looked at already
+							}
+						}
+					}
+				}
+				// Open it again in a bit - meanwhile, the rollout is still checked every so often
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Second):
+				}
+			}
+		}(openWatch)
+	}
+	return changes, func() { close(done) }
+}
+
+// unrecoverablePodState looks for a pod whose containers can't start, or keep crashing
+func unrecoverablePodState(pods []v1.Pod) (string, string) {
+	for _, pod := range pods {
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			waiting := status.State.Waiting
+			if waiting == nil {
+				continue
+			}
+			if fatalWaitingReasons[waiting.Reason] ||
+				(imagePullReasons[waiting.Reason] && time.Since(pod.CreationTimestamp.Time) > imagePullGracePeriod) ||
+				(waiting.Reason == "CrashLoopBackOff" && status.RestartCount >= crashLoopRestarts) {
+				return waiting.Reason, fmt.Sprintf("container %s of pod %s: %s", status.Name, pod.Name, waiting.Message)
+			}
+		}
+	}
+	return "", ""
+}
+
+func diagnosePods(pods []v1.Pod) []PodDiagnosis {
+	var diagnoses []PodDiagnosis
+	for _, pod := range pods {
+		if podReady(pod) || pod.DeletionTimestamp != nil {
+			continue
+		}
+		diagnosis := PodDiagnosis{Name: pod.Name, LogTail: map[string][]string{}}
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			diagnosis.Containers = append(diagnosis.Containers, fmt.Sprintf("%s: %s, %d restarts", status.Name, containerState(status), status.RestartCount))
+			if status.State.Running == nil && status.State.Terminated == nil && status.RestartCount == 0 {
+				continue // never started, so there are no logs
+			}
+			if logTail := containerLogTail(pod.Name, status.Name, status.RestartCount > 0 && status.State.Running == nil); len(logTail) > 0 {
+				diagnosis.LogTail[status.Name] = logTail
+			}
+		}
+		diagnosis.Events = warningEvents(pod.Name)
+		diagnoses = append(diagnoses, diagnosis)
+	}
+	return diagnoses
+}
+
+func podReady(pod v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func containerState(status v1.ContainerStatus) string {
+	switch {
+	case status.State.Waiting != nil:
+		return fmt.Sprintf("waiting (%s) %s", status.State.Waiting.Reason, status.State.Waiting.Message)
+	case status.State.Terminated != nil:
+		return fmt.Sprintf("terminated (%s, exit code %d)", status.State.Terminated.Reason, status.State.Terminated.ExitCode)
+	case status.State.Running != nil && !status.Ready:
+		return "running, not ready"
+	default:
+		return "running"
+	}
+}
+
+// containerLogTail returns the last lines the container logged - from its previous run if it crashed
+func containerLogTail(podName string, containerName string, previous bool) []string {
+	tailLines := int64(20)
+	logs, err := clientSet.CoreV1().Pods(namespace).
+		GetLogs(podName, &v1.PodLogOptions{Container: containerName, TailLines: &tailLines, Previous: previous}).
+		DoRaw()
+	if err != nil || len(logs) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(logs), "\n"), "\n")
+}
+
+// warningEvents returns the five most recent Warning events about the object
+func warningEvents(objectName string) []string {
+	events, err := clientSet.CoreV1().Events(namespace).List(metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("involvedObject.name=%s,type=Warning", objectName),
+	})
+	if err != nil {
+		return nil
+	}
+	sort.Slice(events.Items, func(i, j int) bool {
+		return events.Items[i].LastTimestamp.Before(&events.Items[j].LastTimestamp)
+	})
+	var messages []string
+	for _, event := range events.Items {
+		messages = append(messages, fmt.Sprintf("%s: %s (x%d)", event.Reason, event.Message, event.Count))
+	}
+	if len(messages) > 5 {
+		messages = messages[len(messages)-5:]
+	}
+	return messages
+}
+
+func printRolloutFailure(result RolloutResult) {
+	fmt.Printf("=> Oh no, the %s\n", result)
+	for _, event := range result.Events {
+		fmt.Printf("\t%s\n", event)
+	}
+	for _, pod := range result.FailingPods {
+		fmt.Printf("=> Pod %s isn't ready:\n", pod.Name)
+		for _, container := range pod.Containers {
+			fmt.Printf("\t%s\n", container)
+		}
+		for _, event := range pod.Events {
+			fmt.Printf("\t%s\n", event)
+		}
+		for container, lines := range pod.LogTail {
+			fmt.Printf("   Last log lines of %s:\n", container)
+			for _, line := range lines {
+				fmt.Printf("\t| %s\n", line)
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package kubeapi
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/util/retry"
+)
+
+// StatefulSets and DaemonSets have no progress deadline, so their rollouts get the Deployment default
+const defaultProgressDeadline = 600 * time.Second
+
+func GetStatefulSet(name string) (*appsv1.StatefulSet, error) {
+	return clientSet.AppsV1().StatefulSets(namespace).Get(name, metav1.GetOptions{})
+}
+
+func UpdateStatefulSet(name string, callback func(*appsv1.StatefulSet)) *appsv1.StatefulSet {
+	var statefulSet *appsv1.StatefulSet
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		if statefulSet, err = GetStatefulSet(name); err != nil {
+			return err
+		}
+		callback(statefulSet)
+		statefulSet, err = clientSet.AppsV1().StatefulSets(namespace).Update(statefulSet)
+		return err
+	})
+	if retryErr != nil {
+		panic(fmt.Errorf("Update failed: %v", retryErr))
+	}
+	fmt.Printf("=> Updated statefulset %s.\n", name)
+	return statefulSet
+}
+
+// WaitForStatefulSetRollout watches the StatefulSet until the pods at or above its partition are updated and
+// all of its pods are ready. Like WaitForDeploymentRollout, it prints what's wrong if it gives up.
+func WaitForStatefulSetRollout(name string) RolloutResult {
+	var statefulSet *appsv1.StatefulSet
+	return waitForRollout(rolloutWatch{
+		kind: "StatefulSet",
+		name: name,
+		progress: func() (rolloutProgress, error) {
+			var err error
+			if statefulSet, err = GetStatefulSet(name); err != nil {
+				return rolloutProgress{}, err
+			}
+			return statefulSetProgress(statefulSet), nil
+		},
+		pods:         func() []v1.Pod { return listOwnedPods(statefulSet.Spec.Selector, statefulSet.UID) },
+		eventObjects: func() []string { return []string{statefulSet.Name} },
+		watch: func() (watch.Interface, error) {
+			return clientSet.AppsV1().StatefulSets(namespace).Watch(metav1.ListOptions{FieldSelector: "metadata.name=" + name})
+		},
+		podSelector: func() *metav1.LabelSelector { return statefulSet.Spec.Selector },
+	})
+}
+
+func statefulSetProgress(statefulSet *appsv1.StatefulSet) rolloutProgress {
+	progress := rolloutProgress{deadline: defaultProgressDeadline}
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+	partition := int32(0)
+	if rollingUpdate := statefulSet.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil && rollingUpdate.Partition != nil {
+		partition = *rollingUpdate.Partition
+	}
+
+	status := statefulSet.Status
+	switch {
+	case status.ObservedGeneration == 0 || statefulSet.Generation > status.ObservedGeneration:
+		progress.waitingFor = "the statefulset controller to see the update"
+	case status.Replicas > replicas:
+		progress.waitingFor = fmt.Sprintf("%d pods to be terminated", status.Replicas-replicas)
+	case status.ReadyReplicas < replicas:
+		progress.waitingFor = fmt.Sprintf("%d of %d pods to be ready", replicas-status.ReadyReplicas, replicas)
+	case statefulSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType:
+		// Pods are only updated when someone deletes them, so there's nothing to wait for
+	case partition > 0:
+		if status.UpdatedReplicas < replicas-partition {
+			progress.waitingFor = fmt.Sprintf("%d of %d pods from ordinal %d up to be updated", replicas-partition-status.UpdatedReplicas, replicas-partition, partition)
+		}
+	case status.UpdateRevision != status.CurrentRevision:
+		progress.waitingFor = fmt.Sprintf("%d of %d pods to be updated", replicas-status.UpdatedReplicas, replicas)
+	}
+	return progress
+}
+
+func GetDaemonSet(name string) (*appsv1.DaemonSet, error) {
+	return clientSet.AppsV1().DaemonSets(namespace).Get(name, metav1.GetOptions{})
+}
+
+func UpdateDaemonSet(name string, callback func(*appsv1.DaemonSet)) *appsv1.DaemonSet {
+	var daemonSet *appsv1.DaemonSet
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		if daemonSet, err = GetDaemonSet(name); err != nil {
+			return err
+		}
+		callback(daemonSet)
+		daemonSet, err = clientSet.AppsV1().DaemonSets(namespace).Update(daemonSet)
+		return err
+	})
+	if retryErr != nil {
+		panic(fmt.Errorf("Update failed: %v", retryErr))
+	}
+	fmt.Printf("=> Updated daemonset %s.\n", name)
+	return daemonSet
+}
+
+// WaitForDaemonSetRollout watches the DaemonSet until an updated pod is available on every node it should run on
+func WaitForDaemonSetRollout(name string) RolloutResult {
+	var daemonSet *appsv1.DaemonSet
+	return waitForRollout(rolloutWatch{
+		kind: "DaemonSet",
+		name: name,
+		progress: func() (rolloutProgress, error) {
+			var err error
+			if daemonSet, err = GetDaemonSet(name); err != nil {
+				return rolloutProgress{}, err
+			}
+			return daemonSetProgress(daemonSet), nil
+		},
+		pods:         func() []v1.Pod { return listOwnedPods(daemonSet.Spec.Selector, daemonSet.UID) },
+		eventObjects: func() []string { return []string{daemonSet.Name} },
+		watch: func() (watch.Interface, error) {
+			return clientSet.AppsV1().DaemonSets(namespace).Watch(metav1.ListOptions{FieldSelector: "metadata.name=" + name})
+		},
+		podSelector: func() *metav1.LabelSelector { return daemonSet.Spec.Selector },
+	})
+}
+
+func daemonSetProgress(daemonSet *appsv1.DaemonSet) rolloutProgress {
+	progress := rolloutProgress{deadline: defaultProgressDeadline}
+	status := daemonSet.Status
+	switch {
+	case daemonSet.Generation > status.ObservedGeneration:
+		progress.waitingFor = "the daemonset controller to see the update"
+	case daemonSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType:
+		// Pods are only updated when someone deletes them, so there's nothing to wait for
+	case status.UpdatedNumberScheduled < status.DesiredNumberScheduled:
+		progress.waitingFor = fmt.Sprintf("%d of %d nodes to get an updated pod", status.DesiredNumberScheduled-status.UpdatedNumberScheduled, status.DesiredNumberScheduled)
+	case status.NumberAvailable < status.DesiredNumberScheduled:
+		progress.waitingFor = fmt.Sprintf("%d of %d updated pods to be available", status.DesiredNumberScheduled-status.NumberAvailable, status.DesiredNumberScheduled)
+	}
+	return progress
+}
+
+func GetCronJob(name string) (*batchv1beta1.CronJob, error) {
+	return clientSet.BatchV1beta1().CronJobs(namespace).Get(name, metav1.GetOptions{})
+}
+
+func UpdateCronJob(name string, callback func(*batchv1beta1.CronJob)) *batchv1beta1.CronJob {
+	var cronJob *batchv1beta1.CronJob
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		if cronJob, err = GetCronJob(name); err != nil {
+			return err
+		}
+		callback(cronJob)
+		cronJob, err = clientSet.BatchV1beta1().CronJobs(namespace).Update(cronJob)
+		return err
+	})
+	if retryErr != nil {
+		panic(fmt.Errorf("Update failed: %v", retryErr))
+	}
+	fmt.Printf("=> Updated cronjob %s.\n", name)
+	return cronJob
+}
+
+// RollBackToPreviousRevision puts the pod template of a StatefulSet or DaemonSet back to the one it had before
+// its latest change, like 'kubectl rollout undo'. Rolling back twice swaps back again.
+func RollBackToPreviousRevision(kind string, name string) error {
+	revisions, patch, err := controllerRevisions(kind, name)
+	if err != nil {
+		return err
+	}
+	if len(revisions) < 2 {
+		return fmt.Errorf("%s %s has no previous revision to roll back to", kind, name)
+	}
+	// The revision's data is a patch which replaces the whole pod template
+	previous := revisions[len(revisions)-2]
+	fmt.Printf("=> Rolling %s %s back to revision %d.\n", kind, name, previous.Revision)
+	return patch(previous.Data.Raw)
+}
+
+// CurrentRevision returns the name of the ControllerRevision with the current pod template of a StatefulSet or
+// DaemonSet (or "" if it has none yet)
+func CurrentRevision(kind string, name string) (string, error) {
+	revisions, _, err := controllerRevisions(kind, name)
+	if err != nil || len(revisions) == 0 {
+		return "", err
+	}
+	return revisions[len(revisions)-1].Name, nil
+}
+
+// RollBackToRevision puts the pod template of a StatefulSet or DaemonSet back to the one of the given
+// ControllerRevision, eg. the one from CurrentRevision before a rollout
+func RollBackToRevision(kind string, name string, revisionName string) error {
+	revisions, patch, err := controllerRevisions(kind, name)
+	if err != nil {
+		return err
+	}
+	for _, revision := range revisions {
+		if revision.Name == revisionName {
+			fmt.Printf("=> Rolling %s %s back to revision %d.\n", kind, name, revision.Revision)
+			return patch(revision.Data.Raw)
+		}
+	}
+	return fmt.Errorf("%s %s doesn't have the revision %s any more", kind, name, revisionName)
+}
+
+// controllerRevisions returns the ControllerRevisions of a StatefulSet or DaemonSet, oldest first, and a function to
+// patch the StatefulSet or DaemonSet with the data of one of them
+func controllerRevisions(kind string, name string) ([]appsv1.ControllerRevision, func(data []byte) error, error) {
+	var (
+		selector *metav1.LabelSelector
+		uid      types.UID
+		patch    func(data []byte) error
+	)
+	switch kind {
+	case "StatefulSet":
+		statefulSet, err := GetStatefulSet(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		selector, uid = statefulSet.Spec.Selector, statefulSet.UID
+		patch = func(data []byte) error {
+			_, err := clientSet.AppsV1().StatefulSets(namespace).Patch(name, types.StrategicMergePatchType, data)
+			return err
+		}
+	case "DaemonSet":
+		daemonSet, err := GetDaemonSet(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		selector, uid = daemonSet.Spec.Selector, daemonSet.UID
+		patch = func(data []byte) error {
+			_, err := clientSet.AppsV1().DaemonSets(namespace).Patch(name, types.StrategicMergePatchType, data)
+			return err
+		}
+	default:
+		return nil, nil, fmt.Errorf("%s has no revisions to roll back to", kind)
+	}
+
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	revisions, err := clientSet.AppsV1().ControllerRevisions(namespace).List(metav1.ListOptions{LabelSelector: labelSelector.String()})
+	if err != nil {
+		return nil, nil, err
+	}
+	var ownRevisions []appsv1.ControllerRevision
+	for _, revision := range revisions.Items {
+		if owner := metav1.GetControllerOf(&revision); owner != nil && owner.UID == uid {
+			ownRevisions = append(ownRevisions, revision)
+		}
+	}
+	sort.Slice(ownRevisions, func(i, j int) bool { return ownRevisions[i].Revision < ownRevisions[j].Revision })
+	return ownRevisions, patch, nil
+}
+
+// listOwnedPods returns the pods matching the selector which are controlled by the given owner
+func listOwnedPods(selector *metav1.LabelSelector, owner types.UID) []v1.Pod {
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		panic(err.Error())
+	}
+	pods, err := clientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: labelSelector.String()})
+	if err != nil {
+		panic(err.Error())
+	}
+	var ownedPods []v1.Pod
+	for _, pod := range pods.Items {
+		if controller := metav1.GetControllerOf(&pod); controller != nil && controller.UID == owner {
+			ownedPods = append(ownedPods, pod)
+		}
+	}
+	return ownedPods
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"io/ioutil"
 	"log"
 	"strconv"
@@ -18,9 +17,11 @@ import (
 	"github.com/simonleung8/flags"
 )
 
+// version is set when building a release, with '-ldflags "-X main.version=..."'
+var version = "dev"
+
 // var userConfig userConfigMap
 var repoConfig config.RepoConfigMap
-var reader *bufio.Reader
 var osstdout *os.File
 
 func main() {
@@ -28,7 +29,11 @@ func main() {
 	pwd, _ := os.Getwd()
 	// user, _ := user.Current()
 	// userHome := user.HomeDir
-	reader = bufio.NewReader(os.Stdin)
+
+	// With '--no-build', 'start-rollout' reads the metadata file of an earlier build instead
+	if !runFlags.Bool("no-build") {
+		build.SetMetadataFile(runFlags.String("metadata-file"))
+	}
 
 	osstdout = os.Stdout
 	if runFlags.Bool("quiet") {
@@ -54,6 +59,7 @@ func main() {
 	%s
 `, repoConfig.DockerRepository.RegistryRoot, repoConfig.Application.Name, repoConfig.GitBranch, repoConfig.GitSHA, repoConfig.EnvVarsMap.GetNameSpace(), repoConfig.ImageFullPath)
 	}
+	cli.SetupPrompts(runFlags.Bool("yes"), runFlags.Bool("non-interactive"), repoConfig.Prompts)
 
 	// args has to have at least length 2, since the first element is the executable name
 	if len(args) >= 2 {
@@ -73,46 +79,94 @@ func main() {
 		case "build":
 			build.MakeAndPushBuild(
 				runFlags.Bool("force-push-image"),
-				runFlags.Bool("override-dirty-workdir"),
+				gitChecksToSkip(),
 				runFlags.Bool("keep-test-container"),
+				!runFlags.Bool("no-image-reuse"),
+				runFlags.Bool("skip-scan"),
+				runFlags.Bool("skip-tests"),
 				repoConfig,
 			)
+			if err := build.ResolveImageDigest(&repoConfig); err != nil {
+				log.Fatalf("=> Oh no, %s", err)
+			}
+			build.WriteMetadataFile(repoConfig)
 		case "make":
 			build.MakeAndPushBuild(
 				runFlags.Bool("force-push-image"),
-				runFlags.Bool("override-dirty-workdir"),
+				gitChecksToSkip(),
 				runFlags.Bool("keep-test-container"),
+				!runFlags.Bool("no-image-reuse"),
+				runFlags.Bool("skip-scan"),
+				runFlags.Bool("skip-tests"),
 				repoConfig,
 			)
+			if err := build.ResolveImageDigest(&repoConfig); err != nil {
+				log.Fatalf("=> Oh no, %s", err)
+			}
+			build.WriteMetadataFile(repoConfig)
 		case "test":
 			build.MakeAndTestBuild(
-				runFlags.Bool("override-dirty-workdir"),
+				gitChecksToSkip(),
 				runFlags.Bool("keep-test-container"),
 				repoConfig,
 			)
+			build.WriteMetadataFile(repoConfig)
 		case "testonly":
 			build.RunBuildTests(runFlags.Bool("keep-test-container"), repoConfig)
+			build.WriteMetadataFile(repoConfig)
 
 		case "start-rollout":
 			kubeStartRollout()
 		case "scale":
 			replicas, _ := strconv.ParseInt(args[2], 0, 32)
-			kubeScaleDeployment(int32(replicas))
+			workload := kubeCurrentWorkload()
+			historyStart("scale", fmt.Sprintf("to %d pods", replicas))
+			workload.scale(int32(replicas))
+			historyFinish("succeeded")
 		case "rollback":
-			kubeInstantRollback()
+			if to := runFlags.String("to"); to != "" {
+				kubeRollbackTo(to)
+			} else {
+				workload := kubeCurrentWorkload()
+				historyStart("rollback", "")
+				workload.rollback()
+			}
+			historyFinish("succeeded")
 		case "rolling-restart":
-			kubeRollingRestart()
+			workload := kubeCurrentWorkload()
+			historyStart("rolling-restart", "")
+			workload.rollingRestart()
+			historyFinish("succeeded")
 		case "template-only":
+			templatedFiles := kubeMakeTemplates()
+			if objects, err := kubeDecodeTemplates(templatedFiles); err != nil {
+				fmt.Printf("=> Uh oh, %s\n", err)
+			} else {
+				kubeCheckAPIVersions(objects)
+			}
 			fmt.Println("The files can be found at: ")
-			fmt.Fprint(osstdout, strings.Join(kubeMakeTemplates(), "\n"))
+			fmt.Fprint(osstdout, strings.Join(templatedFiles, "\n"))
+		case "migrate-manifests":
+			kubeMigrateManifests()
 
 		case "remove":
 			kubeRemove()
 
 		case "active-deployments":
 			kubeListDeployments()
+		case "history":
+			kubeShowHistory()
 		case "list-tags":
 			build.DockerListTags(repoConfig.ImageName)
+		case "promote":
+			var sourceTag, targetTag string
+			if len(args) >= 3 {
+				sourceTag = args[2]
+			}
+			if len(args) >= 4 {
+				targetTag = args[3]
+			}
+			build.PromoteImage(sourceTag, targetTag, repoConfig)
 
 		case "status":
 			if status := cli.IsLocked(repoConfig.Application.Name); status == false {
@@ -129,10 +183,7 @@ func main() {
 			cli.DeleteLockFile("all")
 		default:
 			{
-				fmt.Println("=> Uh oh - that command isn't recongised. Please enter a valid command. Do you need some help?")
-				fmt.Print("=> Press 'y' to show the help menu, anything else to exit.\n>>>  ")
-				pleaseHelpMe, _ := reader.ReadString('\n')
-				if pleaseHelpMe != "y\n" && pleaseHelpMe != "Y\n" {
+				if !cli.AskToProceed("show-help", "Uh oh - that command isn't recongised. Please enter a valid command. Do you need some help?") {
 					log.Fatal("Better luck next time.")
 				}
 				showHelp()
@@ -143,12 +194,13 @@ func main() {
 	}
 }
 
-func askToProceed(promptMessage string) bool {
-	fmt.Printf("=> %s\n=> Press 'y' to proceed, anything else to exit.\n>>> ", promptMessage)
-	if proceed, _ := reader.ReadString('\n'); proceed != "y\n" && proceed != "Y\n" {
-		return false
+// gitChecksToSkip returns the names of the git checks which shouldn't stop the build
+func gitChecksToSkip() []string {
+	skip := runFlags.StringSlice("skip-git-check")
+	if runFlags.Bool("override-dirty-workdir") {
+		skip = append(skip, "clean", "untracked")
 	}
-	return true
+	return skip
 }
 
 func showHelp() {
@@ -168,14 +220,25 @@ func parseFlags() {
 
 	runFlags = flags.New()
 	runFlags.NewBoolFlag("debug", "", "Print extra-fun information.")
-	runFlags.NewBoolFlag("override-dirty-workdir", "", "Forces a build even if the git working directory is dirty (only needed for 'production' and 'master' branches).")
+	runFlags.NewBoolFlag("override-dirty-workdir", "", "Forces a build even if the git working directory is dirty (the same as skipping the 'clean' and 'untracked' git checks).")
+	runFlags.NewStringSliceFlag("skip-git-check", "", "Skips one of the git checks before building (can be repeated): clean, untracked, pushed, behind, signed, tagged.")
 	runFlags.NewBoolFlag("force", "", "Unwisely bypasses the sanity checks, which you really need. Even you.")
 	runFlags.NewBoolFlag("force-push-image", "", "Automatically push the built Docker image if the tests pass (useful for CI/CD).")
 	runFlags.NewBoolFlag("keep-test-container", "", "Don't clean up (docker rm) the test containers (Default false).")
+	runFlags.NewBoolFlag("verify-image-digest", "", "Check that the pods of the new release run the exact image digest that was pushed.")
 	runFlags.NewBoolFlag("no-canary", "", "Bypass the canary release points (useful for CI/CD).")
 	runFlags.NewBoolFlag("no-build", "", "Skip build during rollout")
+	runFlags.NewBoolFlag("skip-scan", "", "Push the image without the vulnerability scan (not allowed for the production cluster).")
+	runFlags.NewBoolFlag("skip-tests", "", "Push a Kaniko build without the test sets, which need a local docker daemon (not allowed for the production cluster).")
+	runFlags.NewBoolFlag("no-image-reuse", "", "Always build the image, even if an image with the same content already exists.")
+	runFlags.NewStringFlag("metadata-file", "", "Write the details of the build (image, digest, test results, etc.) to this JSON file - or read them from it for 'start-rollout --no-build'.")
 	runFlags.NewBoolFlag("test-only", "", "Skips the run configuration and only tests that the binary can start.")
+	runFlags.NewBoolFlag("yes", "y", "Answers 'y' to every prompt (including the canary points!).")
+	runFlags.NewBoolFlag("non-interactive", "", "Never waits for input - prompts get the default answer from the 'prompts' section of the deploy.yaml (automatic without a terminal).")
 	runFlags.NewBoolFlag("quiet", "q", "Silences as much output as possible.")
+	runFlags.NewBoolFlag("dry-run", "", "For 'remove': only checks with the API server that the objects could be removed. For 'migrate-manifests': only prints what would change.")
+	runFlags.NewStringFlag("to", "", "For 'rollback': the release to roll back to - its name, its git SHA, or how many releases back from the live one (eg. 2).")
+	runFlags.NewBoolFlag("json", "", "For 'history': prints the history as JSON instead of a table.")
 	runFlags.NewBoolFlag("keep-kubernetes-template-files", "", "Leaves the templated-out kubernetes files under the directory '.kubedeploy-temp'.")
 	if err := runFlags.Parse(os.Args...); err != nil {
 		log.Println("\n=> Oh no, I don't know what to do with those command line flags. Sorry...")
@@ -0,0 +1,219 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+type client struct {
+	httpClient *http.Client
+	authHeader map[string]string // the Authorization header to send, by host and scope
+}
+
+type credentials struct {
+	Username string
+	Secret   string
+}
+
+func newClient() *client {
+	return &client{
+		httpClient: &http.Client{},
+		authHeader: map[string]string{},
+	}
+}
+
+func (r Reference) scope(actions string) string {
+	return fmt.Sprintf("repository:%s:%s", r.Repository, actions)
+}
+
+// do sends a request to the registry of the reference, logging in for the given actions on its repository
+// (plus any extra scopes) if the registry asks for it
+func (c *client) do(method string, ref Reference, path string, headers map[string]string, body []byte, actions string, extraScopes ...string) (*http.Response, error) {
+	authKey := ref.Host + " " + strings.Join(append([]string{ref.scope(actions)}, extraScopes...), " ")
+
+	newRequest := func() (*http.Request, error) {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, ref.baseURL()+path, reader)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		if header, ok := c.authHeader[authKey]; ok {
+			req.Header.Set("Authorization", header)
+		}
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Log in with the challenge from the registry, then try once more
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	header, err := c.login(ref.Host, challenge, append([]string{ref.scope(actions)}, extraScopes...))
+	if err != nil {
+		return nil, err
+	}
+	c.authHeader[authKey] = header
+
+	if req, err = newRequest(); err != nil {
+		return nil, err
+	}
+	return c.httpClient.Do(req)
+}
+
+// send sends a request which can't be repeated (eg. one streaming a blob), using a login from an earlier request
+func (c *client) send(req *http.Request, ref Reference, actions string) (*http.Response, error) {
+	if header, ok := c.authHeader[ref.Host+" "+ref.scope(actions)]; ok {
+		req.Header.Set("Authorization", header)
+	}
+	return c.httpClient.Do(req)
+}
+
+// login returns the Authorization header to use for the scopes, following the registry's 'WWW-Authenticate' challenge
+func (c *client) login(host string, challenge string, scopes []string) (string, error) {
+	creds, err := credentialsFor(host)
+	if err != nil {
+		return "", err
+	}
+
+	params := map[string]string{}
+	for _, match := range challengeParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+
+	switch {
+	case strings.HasPrefix(challenge, "Basic"):
+		if creds == nil {
+			return "", fmt.Errorf("the registry %s needs a login, but no docker credentials were found for it", host)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.Username+":"+creds.Secret)), nil
+	case strings.HasPrefix(challenge, "Bearer"):
+		query := url.Values{}
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		for _, scope := range scopes {
+			query.Add("scope", scope)
+		}
+		req, err := http.NewRequest("GET", params["realm"]+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		if creds != nil {
+			req.SetBasicAuth(creds.Username, creds.Secret)
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			return "", fmt.Errorf("getting a token from %s failed with status %s: %s", params["realm"], resp.Status, strings.TrimSpace(string(body)))
+		}
+		token := struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return "", err
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		return "Bearer " + token.Token, nil
+	default:
+		return "", fmt.Errorf("the registry %s asked for an unsupported kind of login: '%s'", host, challenge)
+	}
+}
+
+// credentialsFor looks up the login for a registry in the docker config file (or the credential helper it points to)
+func credentialsFor(host string) (*credentials, error) {
+	dockerConfigFile, err := ioutil.ReadFile(os.Getenv("HOME") + "/.docker/config.json")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	dockerConfig := struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+		CredHelpers map[string]string `json:"credHelpers"`
+		CredsStore  string            `json:"credsStore"`
+	}{}
+	if err := json.Unmarshal(dockerConfigFile, &dockerConfig); err != nil {
+		return nil, fmt.Errorf("couldn't parse the docker config file: %v", err)
+	}
+
+	serverNames := []string{host, "https://" + host, "http://" + host}
+	if host == "registry-1.docker.io" {
+		serverNames = append(serverNames, "https://index.docker.io/v1/", "index.docker.io")
+	}
+
+	for _, serverName := range serverNames {
+		if helper, ok := dockerConfig.CredHelpers[serverName]; ok {
+			return credentialsFromHelper(helper, serverName)
+		}
+	}
+	for _, serverName := range serverNames {
+		if auth, ok := dockerConfig.Auths[serverName]; ok && auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't decode the docker login for %s: %v", serverName, err)
+			}
+			split := strings.SplitN(string(decoded), ":", 2)
+			if len(split) != 2 {
+				return nil, fmt.Errorf("the docker login for %s isn't in the format 'user:password'", serverName)
+			}
+			return &credentials{Username: split[0], Secret: split[1]}, nil
+		}
+	}
+	if dockerConfig.CredsStore != "" {
+		for _, serverName := range serverNames {
+			if _, ok := dockerConfig.Auths[serverName]; ok {
+				return credentialsFromHelper(dockerConfig.CredsStore, serverName)
+			}
+		}
+	}
+	return nil, nil
+}
+
+func credentialsFromHelper(helper string, serverName string) (*credentials, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverName)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("the docker credential helper '%s' failed for %s: %v", helper, serverName, err)
+	}
+	creds := credentials{}
+	if err := json.Unmarshal(output, &creds); err != nil {
+		return nil, fmt.Errorf("couldn't parse the output of the docker credential helper '%s': %v", helper, err)
+	}
+	return &creds, nil
+}
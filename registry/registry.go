@@ -0,0 +1,388 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeForeignLayer       = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+var acceptedManifestTypes = strings.Join([]string{
+	mediaTypeDockerManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+}, ", ")
+
+// Reference : an image reference split into the parts the registry API needs
+type Reference struct {
+	Host       string // registry host, eg. 'eu.gcr.io' or 'localhost:5000'
+	Repository string // path of the repository inside the registry, eg. 'my-project/my-app'
+	Tag        string // tag or digest
+}
+
+// ParseReference splits an image name like 'eu.gcr.io/project/app:tag' into its registry host, repository and tag
+func ParseReference(imageRef string) Reference {
+	ref := Reference{Tag: "latest"}
+
+	name := imageRef
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Tag = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+	}
+
+	// The first part of the name is only a registry host if it looks like one - otherwise it's a Docker Hub image
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Host, ref.Repository = parts[0], parts[1]
+	} else {
+		ref.Host, ref.Repository = "registry-1.docker.io", name
+		if !strings.Contains(name, "/") {
+			ref.Repository = "library/" + name
+		}
+	}
+	return ref
+}
+
+func (r Reference) String() string {
+	if strings.HasPrefix(r.Tag, "sha256:") {
+		return fmt.Sprintf("%s/%s@%s", r.Host, r.Repository, r.Tag)
+	}
+	return fmt.Sprintf("%s/%s:%s", r.Host, r.Repository, r.Tag)
+}
+
+func (r Reference) baseURL() string {
+	// Like docker, talk plain http to registries running on this machine (eg. a local 'registry:2' container)
+	if strings.HasPrefix(r.Host, "localhost") || strings.HasPrefix(r.Host, "127.0.0.1") {
+		return "http://" + r.Host
+	}
+	return "https://" + r.Host
+}
+
+type manifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+// CopyImage copies an image (including all platforms of a multi-platform image) between two repositories
+// through the registry API, without pulling it. Returns the digest of the copied manifest.
+func CopyImage(sourceImage string, destinationImage string) (string, error) {
+	source := ParseReference(sourceImage)
+	destination := ParseReference(destinationImage)
+	c := newClient()
+	return c.copyManifest(source, destination, source.Tag, destination.Tag)
+}
+
+// ImageExists checks whether the registry has a manifest for the image
+func ImageExists(imageRef string) (bool, error) {
+	ref := ParseReference(imageRef)
+	c := newClient()
+
+	resp, err := c.do("HEAD", ref, fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, ref.Tag),
+		map[string]string{"Accept": acceptedManifestTypes}, nil, "pull")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError("checking manifest", ref, resp)
+	}
+}
+
+// ManifestDigest returns the digest of the image's manifest (or manifest list), which identifies the image immutably
+func ManifestDigest(imageRef string) (string, error) {
+	ref := ParseReference(imageRef)
+	c := newClient()
+
+	resp, err := c.do("HEAD", ref, fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, ref.Tag),
+		map[string]string{"Accept": acceptedManifestTypes}, nil, "pull")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError("checking manifest", ref, resp)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	_, _, digest, err := c.getManifest(ref, ref.Tag)
+	return digest, err
+}
+
+// ImageLabels returns the labels in the config of the image (of its first platform, for a multi-platform image)
+func ImageLabels(imageRef string) (map[string]string, error) {
+	ref := ParseReference(imageRef)
+	c := newClient()
+
+	tag := ref.Tag
+	for {
+		body, mediaType, _, err := c.getManifest(ref, tag)
+		if err != nil {
+			return nil, err
+		}
+		parsed := manifest{}
+		if err := json.Unmarshal(body, &parsed); err != nil {
+			return nil, fmt.Errorf("couldn't parse the manifest of %s: %v", ref, err)
+		}
+
+		switch mediaType {
+		case mediaTypeDockerManifestList, mediaTypeOCIIndex:
+			if len(parsed.Manifests) == 0 {
+				return nil, fmt.Errorf("the manifest list of %s is empty", ref)
+			}
+			tag = parsed.Manifests[0].Digest
+			continue
+		case mediaTypeDockerManifest, mediaTypeOCIManifest:
+		default:
+			return nil, fmt.Errorf("the manifest of %s has the unsupported type '%s'", ref, mediaType)
+		}
+
+		resp, err := c.do("GET", ref, fmt.Sprintf("/v2/%s/blobs/%s", ref.Repository, parsed.Config.Digest), nil, nil, "pull")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, responseError("getting the image config", ref, resp)
+		}
+		imageConfig := struct {
+			Config struct {
+				Labels map[string]string `json:"Labels"`
+			} `json:"config"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&imageConfig); err != nil {
+			return nil, fmt.Errorf("couldn't parse the image config of %s: %v", ref, err)
+		}
+		return imageConfig.Config.Labels, nil
+	}
+}
+
+// DeleteTag removes a tag from the registry, leaving the manifest it points to (and any other tags of it) alone.
+// Not every registry can delete a tag on its own - those answer with an error.
+func DeleteTag(imageRef string) error {
+	ref := ParseReference(imageRef)
+	if strings.HasPrefix(ref.Tag, "sha256:") {
+		return fmt.Errorf("%s is a digest, not a tag", ref)
+	}
+	c := newClient()
+
+	resp, err := c.do("DELETE", ref, fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, ref.Tag), nil, nil, "pull,push,delete")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return responseError("deleting tag", ref, resp)
+	}
+	return nil
+}
+
+// ListTags returns all of the tags in the repository of the given image name
+func ListTags(imageName string) ([]string, error) {
+	ref := ParseReference(imageName)
+	c := newClient()
+
+	resp, err := c.do("GET", ref, fmt.Sprintf("/v2/%s/tags/list", ref.Repository), nil, nil, "pull")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError("listing tags", ref, resp)
+	}
+
+	tagList := struct {
+		Tags []string `json:"tags"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tagList); err != nil {
+		return nil, err
+	}
+	return tagList.Tags, nil
+}
+
+func (c *client) copyManifest(source Reference, destination Reference, sourceTag string, destinationTag string) (string, error) {
+	body, mediaType, digest, err := c.getManifest(source, sourceTag)
+	if err != nil {
+		return "", err
+	}
+
+	parsed := manifest{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("couldn't parse the manifest of %s: %v", source, err)
+	}
+
+	switch mediaType {
+	case mediaTypeDockerManifestList, mediaTypeOCIIndex:
+		// Each platform's manifest has to exist in the destination before the list referring to them can be pushed
+		for _, m := range parsed.Manifests {
+			if _, err := c.copyManifest(source, destination, m.Digest, m.Digest); err != nil {
+				return "", err
+			}
+		}
+	case mediaTypeDockerManifest, mediaTypeOCIManifest:
+		blobs := []string{parsed.Config.Digest}
+		for _, l := range parsed.Layers {
+			if l.MediaType != mediaTypeForeignLayer { // foreign layers are never stored in the registry
+				blobs = append(blobs, l.Digest)
+			}
+		}
+		for _, blob := range blobs {
+			if err := c.copyBlob(source, destination, blob); err != nil {
+				return "", err
+			}
+		}
+	default:
+		return "", fmt.Errorf("the manifest of %s has the unsupported type '%s'", source, mediaType)
+	}
+
+	if err := c.putManifest(destination, destinationTag, body, mediaType); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+func (c *client) getManifest(ref Reference, tag string) ([]byte, string, string, error) {
+	resp, err := c.do("GET", ref, fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, tag),
+		map[string]string{"Accept": acceptedManifestTypes}, nil, "pull")
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", responseError("getting manifest", Reference{ref.Host, ref.Repository, tag}, resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+	mediaType := strings.Split(resp.Header.Get("Content-Type"), ";")[0]
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		// Not all registries send the digest header, but the digest is just the hash of the manifest
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+	return body, mediaType, digest, nil
+}
+
+func (c *client) putManifest(ref Reference, tag string, body []byte, mediaType string) error {
+	resp, err := c.do("PUT", ref, fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, tag),
+		map[string]string{"Content-Type": mediaType}, body, "pull,push")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return responseError("pushing manifest", Reference{ref.Host, ref.Repository, tag}, resp)
+	}
+	return nil
+}
+
+func (c *client) copyBlob(source Reference, destination Reference, digest string) error {
+	// Nothing to do if the destination already has the blob
+	resp, err := c.do("HEAD", destination, fmt.Sprintf("/v2/%s/blobs/%s", destination.Repository, digest), nil, nil, "pull,push")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	// Inside the same registry, try to mount the blob from the source repository instead of uploading it again
+	uploadPath := fmt.Sprintf("/v2/%s/blobs/uploads/", destination.Repository)
+	if source.Host == destination.Host {
+		uploadPath += fmt.Sprintf("?mount=%s&from=%s", url.QueryEscape(digest), url.QueryEscape(source.Repository))
+	}
+	resp, err = c.do("POST", destination, uploadPath, nil, nil, "pull,push", source.scope("pull"))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusAccepted:
+	default:
+		return responseError("starting blob upload", destination, resp)
+	}
+	uploadLocation, err := resolveLocation(destination, resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+
+	// Stream the blob from the source straight into a single upload to the destination
+	blob, err := c.do("GET", source, fmt.Sprintf("/v2/%s/blobs/%s", source.Repository, digest), nil, nil, "pull")
+	if err != nil {
+		return err
+	}
+	defer blob.Body.Close()
+	if blob.StatusCode != http.StatusOK {
+		return responseError("getting blob "+digest, source, blob)
+	}
+
+	query := uploadLocation.Query()
+	query.Set("digest", digest)
+	uploadLocation.RawQuery = query.Encode()
+	req, err := http.NewRequest("PUT", uploadLocation.String(), blob.Body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = blob.ContentLength
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = c.send(req, destination, "pull,push")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError("uploading blob "+digest, destination, resp)
+	}
+	return nil
+}
+
+// resolveLocation turns the (possibly relative) upload location returned by the registry into a full URL
+func resolveLocation(ref Reference, location string) (*url.URL, error) {
+	base, err := url.Parse(ref.baseURL())
+	if err != nil {
+		return nil, err
+	}
+	relative, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(relative), nil
+}
+
+func responseError(action string, ref Reference, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s for %s failed with status %s: %s", action, ref, resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,279 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type storedManifest struct {
+	body      []byte
+	mediaType string
+}
+
+// fakeRegistry : an in-memory registry with the parts of the registry API that copying an image uses, like a local
+// 'registry:2' - optionally without the Docker-Content-Digest header, which not every registry sends
+type fakeRegistry struct {
+	sync.Mutex
+	manifests  map[string]storedManifest // by '<repository>:<tag or digest>'
+	blobs      map[string][]byte         // by '<repository>@<digest>'
+	uploads    int
+	mounts     int
+	sendDigest bool
+}
+
+func newFakeRegistry(sendDigest bool) (*fakeRegistry, *httptest.Server) {
+	registry := &fakeRegistry{manifests: map[string]storedManifest{}, blobs: map[string][]byte{}, sendDigest: sendDigest}
+	return registry, httptest.NewServer(registry)
+}
+
+func digestOf(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+func (f *fakeRegistry) addBlob(repository string, content []byte) string {
+	digest := digestOf(content)
+	f.blobs[repository+"@"+digest] = content
+	return digest
+}
+
+func (f *fakeRegistry) addManifest(repository string, tag string, mediaType string, content interface{}) []byte {
+	body, _ := json.Marshal(content)
+	f.manifests[repository+":"+tag] = storedManifest{body, mediaType}
+	f.manifests[repository+":"+digestOf(body)] = storedManifest{body, mediaType}
+	return body
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(path, "/manifests/"):
+		split := strings.SplitN(path, "/manifests/", 2)
+		f.serveManifest(w, r, split[0], split[1])
+	case strings.Contains(path, "/blobs/uploads/"):
+		split := strings.SplitN(path, "/blobs/uploads/", 2)
+		f.serveUpload(w, r, split[0], split[1])
+	case strings.Contains(path, "/blobs/"):
+		split := strings.SplitN(path, "/blobs/", 2)
+		blob, ok := f.blobs[split[0]+"@"+split[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+		if r.Method == "GET" {
+			w.Write(blob)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repository string, reference string) {
+	switch r.Method {
+	case "GET", "HEAD":
+		stored, ok := f.manifests[repository+":"+reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", stored.mediaType)
+		if f.sendDigest {
+			w.Header().Set("Docker-Content-Digest", digestOf(stored.body))
+		}
+		if r.Method == "GET" {
+			w.Write(stored.body)
+		}
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		parsed := manifest{}
+		json.Unmarshal(body, &parsed)
+		// Like a real registry, refuse a manifest referring to anything the repository doesn't have
+		for _, m := range parsed.Manifests {
+			if _, ok := f.manifests[repository+":"+m.Digest]; !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "manifest %s unknown", m.Digest)
+				return
+			}
+		}
+		for _, l := range append(parsed.Layers, struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+		}{Digest: parsed.Config.Digest}) {
+			if _, ok := f.blobs[repository+"@"+l.Digest]; l.Digest != "" && l.MediaType != mediaTypeForeignLayer && !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "blob %s unknown", l.Digest)
+				return
+			}
+		}
+		stored := storedManifest{body, r.Header.Get("Content-Type")}
+		f.manifests[repository+":"+reference] = stored
+		f.manifests[repository+":"+digestOf(body)] = stored
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repository string, upload string) {
+	switch {
+	case r.Method == "POST" && r.URL.Query().Get("mount") != "":
+		digest := r.URL.Query().Get("mount")
+		if blob, ok := f.blobs[r.URL.Query().Get("from")+"@"+digest]; ok {
+			f.blobs[repository+"@"+digest] = blob
+			f.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		fallthrough
+	case r.Method == "POST":
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/upload-%d?state=abc", repository, f.uploads))
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		digest := r.URL.Query().Get("digest")
+		if digestOf(body) != digest || r.URL.Query().Get("state") != "abc" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "digest invalid")
+			return
+		}
+		f.blobs[repository+"@"+digest] = body
+		f.uploads++
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// imageManifest returns a single-platform manifest with the given config and layer blobs
+func imageManifest(config string, layers ...string) map[string]interface{} {
+	var layerList []map[string]string
+	for _, layer := range layers {
+		layerList = append(layerList, map[string]string{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "digest": layer})
+	}
+	return map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeDockerManifest,
+		"config":        map[string]string{"mediaType": "application/vnd.docker.container.image.v1+json", "digest": config},
+		"layers":        layerList,
+	}
+}
+
+func TestCopyImage(t *testing.T) {
+	for _, sendDigest := range []bool{true, false} {
+		registry, server := newFakeRegistry(sendDigest)
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		config := registry.addBlob("project/app", []byte(`{"architecture": "amd64"}`))
+		layer := registry.addBlob("project/app", []byte("layer"))
+		body := registry.addManifest("project/app", "v1", mediaTypeDockerManifest, imageManifest(config, layer))
+
+		// Within the registry the blobs are mounted, and across repositories of another registry they're uploaded
+		digest, err := CopyImage(host+"/project/app:v1", host+"/project/app-production:v1")
+		if err != nil {
+			t.Fatalf("copying within the registry failed: %v", err)
+		}
+		if digest != digestOf(body) {
+			t.Errorf("expected the digest %s (with the digest header: %t), got '%s'", digestOf(body), sendDigest, digest)
+		}
+		if registry.mounts != 2 || registry.uploads != 0 {
+			t.Errorf("expected 2 mounts and no uploads, got %d mounts and %d uploads", registry.mounts, registry.uploads)
+		}
+		if _, ok := registry.manifests["project/app-production:v1"]; !ok {
+			t.Errorf("the copy isn't tagged v1")
+		}
+
+		otherRegistry, otherServer := newFakeRegistry(sendDigest)
+		digest, err = CopyImage(host+"/project/app:v1", strings.TrimPrefix(otherServer.URL, "http://")+"/mirror/app:latest")
+		if err != nil {
+			t.Fatalf("copying to another registry failed: %v", err)
+		}
+		if digest != digestOf(body) || otherRegistry.uploads != 2 {
+			t.Errorf("expected the digest %s and 2 uploads, got '%s' and %d uploads", digestOf(body), digest, otherRegistry.uploads)
+		}
+
+		server.Close()
+		otherServer.Close()
+	}
+}
+
+func TestCopyMultiPlatformImage(t *testing.T) {
+	registry, server := newFakeRegistry(false)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var platforms []map[string]interface{}
+	for _, architecture := range []string{"amd64", "arm64"} {
+		config := registry.addBlob("app", []byte(fmt.Sprintf(`{"architecture": "%s"}`, architecture)))
+		layer := registry.addBlob("app", []byte("layer for "+architecture))
+		body := registry.addManifest("app", "build-"+architecture, mediaTypeDockerManifest, imageManifest(config, layer))
+		platforms = append(platforms, map[string]interface{}{"mediaType": mediaTypeDockerManifest, "digest": digestOf(body), "size": len(body)})
+	}
+	list := registry.addManifest("app", "v2", mediaTypeDockerManifestList, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeDockerManifestList,
+		"manifests":     platforms,
+	})
+
+	digest, err := CopyImage(host+"/app:v2", host+"/app-copy:v2")
+	if err != nil {
+		t.Fatalf("copying failed: %v", err)
+	}
+	if digest != digestOf(list) {
+		t.Errorf("expected the digest of the manifest list %s, got '%s'", digestOf(list), digest)
+	}
+	if registry.mounts != 4 {
+		t.Errorf("expected the 4 blobs of both platforms to be mounted, got %d mounts", registry.mounts)
+	}
+
+	digest, err = ManifestDigest(host + "/app-copy:v2")
+	if err != nil || digest != digestOf(list) {
+		t.Errorf("expected the copy to have the digest %s, got '%s' (%v)", digestOf(list), digest, err)
+	}
+}
+
+func TestCopyMissingImage(t *testing.T) {
+	_, server := newFakeRegistry(true)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	if _, err := CopyImage(host+"/app:nope", host+"/app-copy:nope"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+}
+
+func TestImageLabels(t *testing.T) {
+	registry, server := newFakeRegistry(true)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	config := registry.addBlob("app", []byte(`{"architecture": "amd64", "config": {"Labels": {"kubedeploy-tests": "passed"}}}`))
+	body := registry.addManifest("app", "v1", mediaTypeDockerManifest, imageManifest(config))
+	registry.addManifest("app", "v1-list", mediaTypeDockerManifestList, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeDockerManifestList,
+		"manifests":     []map[string]interface{}{{"mediaType": mediaTypeDockerManifest, "digest": digestOf(body)}},
+	})
+	unlabelled := registry.addBlob("app", []byte(`{"architecture": "amd64", "config": {}}`))
+	registry.addManifest("app", "old", mediaTypeDockerManifest, imageManifest(unlabelled))
+
+	for _, tag := range []string{"v1", "v1-list"} {
+		labels, err := ImageLabels(host + "/app:" + tag)
+		if err != nil || labels["kubedeploy-tests"] != "passed" {
+			t.Errorf("%s: expected the label kubedeploy-tests=passed, got %v (%v)", tag, labels, err)
+		}
+	}
+	labels, err := ImageLabels(host + "/app:old")
+	if err != nil || len(labels) != 0 {
+		t.Errorf("expected no labels, got %v (%v)", labels, err)
+	}
+}